@@ -0,0 +1,36 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"sync"
+)
+
+// BufferPool is a pool of buffers for rendering templates.
+type BufferPool interface {
+	// Get returns an empty buffer from the pool.
+	Get() *bytes.Buffer
+	// Put returns the buffer to the pool, which has been reset.
+	Put(buf *bytes.Buffer)
+}
+
+var _ BufferPool = (*syncBufferPool)(nil)
+
+// syncBufferPool is the default BufferPool backed by a sync.Pool.
+type syncBufferPool struct {
+	pool sync.Pool
+}
+
+func newSyncBufferPool() *syncBufferPool {
+	return &syncBufferPool{
+		pool: sync.Pool{
+			New: func() interface{} { return new(bytes.Buffer) },
+		},
+	}
+}
+
+func (p *syncBufferPool) Get() *bytes.Buffer    { return p.pool.Get().(*bytes.Buffer) }
+func (p *syncBufferPool) Put(buf *bytes.Buffer) { p.pool.Put(buf) }
@@ -0,0 +1,112 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+)
+
+// rawTextElements are elements whose content is not parsed as markup, thus
+// "<!--" within them is not the start of a comment.
+var rawTextElements = []string{"script", "style", "textarea", "title"}
+
+// stripHTMLComments is the post-processor of Options.StripHTMLComments, which
+// removes HTML comments from the body. Conditional comments (e.g.
+// `<!--[if IE]>...<![endif]-->`), CDATA sections and content of raw text
+// elements like <script> and <style> are preserved. Unterminated comments are
+// left as-is.
+func stripHTMLComments(_ string, body []byte) ([]byte, error) {
+	if !bytes.Contains(body, []byte("<!--")) {
+		return body, nil
+	}
+
+	out := make([]byte, 0, len(body))
+	for len(body) > 0 {
+		i := bytes.IndexByte(body, '<')
+		if i < 0 {
+			out = append(out, body...)
+			break
+		}
+		out = append(out, body[:i]...)
+		body = body[i:]
+
+		// Copy everything up to the end of a section verbatim.
+		if end := rawSectionEnd(body); end > 0 {
+			out = append(out, body[:end]...)
+			body = body[end:]
+			continue
+		}
+
+		// Keep conditional comments, including the `<!-->` that reveals content of
+		// downlevel-revealed ones to other browsers.
+		if !bytes.HasPrefix(body, []byte("<!--")) ||
+			bytes.HasPrefix(body, []byte("<!--[if")) ||
+			bytes.HasPrefix(body, []byte("<!--<![endif]")) ||
+			bytes.HasPrefix(body, []byte("<!-->")) {
+			out = append(out, '<')
+			body = body[1:]
+			continue
+		}
+
+		end := bytes.Index(body[len("<!--"):], []byte("-->"))
+		if end < 0 {
+			out = append(out, body...)
+			break
+		}
+		body = body[len("<!--")+end+len("-->"):]
+	}
+	return out, nil
+}
+
+// rawSectionEnd returns the length of the CDATA section or the raw text element
+// at the start of the body up to and including its end, or 0 if the body does
+// not start with one. The rest of the body is returned as the section when it
+// is not closed.
+func rawSectionEnd(body []byte) int {
+	if bytes.HasPrefix(body, []byte("<![CDATA[")) {
+		end := bytes.Index(body, []byte("]]>"))
+		if end < 0 {
+			return len(body)
+		}
+		return end + len("]]>")
+	}
+
+	for _, name := range rawTextElements {
+		if !hasTagPrefix(body, "<"+name) {
+			continue
+		}
+
+		from := len(name) + 1
+		for {
+			end := bytes.Index(body[from:], []byte("</"))
+			if end < 0 {
+				return len(body)
+			}
+			end += from
+			if hasTagPrefix(body[end:], "</"+name) {
+				gt := bytes.IndexByte(body[end:], '>')
+				if gt < 0 {
+					return len(body)
+				}
+				return end + gt + 1
+			}
+			from = end + len("</")
+		}
+	}
+	return 0
+}
+
+// hasTagPrefix returns true if the body starts with the tag case-insensitively,
+// followed by a character that ends the tag name.
+func hasTagPrefix(body []byte, tag string) bool {
+	if len(body) <= len(tag) || !bytes.EqualFold(body[:len(tag)], []byte(tag)) {
+		return false
+	}
+	switch body[len(tag)] {
+	case '>', '/', ' ', '\t', '\n', '\r', '\f':
+		return true
+	}
+	return false
+}
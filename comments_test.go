@@ -0,0 +1,107 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	gotemplate "html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/flamego/flamego"
+)
+
+func TestStripHTMLComments(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "no comment",
+			body: "<p>Hello</p>",
+			want: "<p>Hello</p>",
+		},
+		{
+			name: "comments",
+			body: "<!-- header --><p>Hello<!-- name --></p><!---->",
+			want: "<p>Hello</p>",
+		},
+		{
+			name: "multiline comment",
+			body: "<p>a</p><!--\n  internal\n  note\n--><p>b</p>",
+			want: "<p>a</p><p>b</p>",
+		},
+		{
+			name: "conditional comments",
+			body: "<!--[if IE]><p>IE</p><![endif]--><!--[if !IE]><!--><p>Not IE</p><!--<![endif]-->",
+			want: "<!--[if IE]><p>IE</p><![endif]--><!--[if !IE]><!--><p>Not IE</p><!--<![endif]-->",
+		},
+		{
+			name: "script and style",
+			body: `<script>var s = "<!-- x -->";</script><STYLE type="text/css"><!-- p {} --></STYLE><!-- x -->`,
+			want: `<script>var s = "<!-- x -->";</script><STYLE type="text/css"><!-- p {} --></STYLE>`,
+		},
+		{
+			name: "script with other closing tags",
+			body: `<script>document.write("</p><!-- x -->")</script><!-- x --><scripts><!-- x --></scripts>`,
+			want: `<script>document.write("</p><!-- x -->")</script><scripts></scripts>`,
+		},
+		{
+			name: "textarea",
+			body: "<textarea><!-- x --></textarea>",
+			want: "<textarea><!-- x --></textarea>",
+		},
+		{
+			name: "CDATA",
+			body: "<svg><![CDATA[<!-- x -->]]></svg><!-- x -->",
+			want: "<svg><![CDATA[<!-- x -->]]></svg>",
+		},
+		{
+			name: "unterminated comment",
+			body: "<p>a</p><!-- x",
+			want: "<p>a</p><!-- x",
+		},
+		{
+			name: "unclosed script",
+			body: "<script><!-- x -->",
+			want: "<script><!-- x -->",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := stripHTMLComments("test", []byte(test.body))
+			require.Nil(t, err)
+			assert.Equal(t, test.want, string(got))
+		})
+	}
+}
+
+func TestTemplate_StripHTMLComments(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory:         "testdata/fragments",
+			StripHTMLComments: true,
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Title"] = gotemplate.HTML("Flamego<!-- internal note -->")
+		t.HTML(http.StatusOK, "header")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<header>Flamego</header>", resp.Body.String())
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"fmt"
+	gotemplate "html/template"
+	"net/http"
+
+	"github.com/flamego/flamego"
+)
+
+var debugPage = gotemplate.Must(gotemplate.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Templates</title></head>
+<body>
+<h1>Templates</h1>
+<p>{{.Count}} templates, {{.TotalBytes}} bytes in total.</p>
+<table>
+<tr><th>Name</th><th>Source</th><th>Size</th></tr>
+{{- range .Templates}}
+<tr><td><a href="?name={{.Name}}">{{.Name}}</a></td><td>{{.Origin}}</td><td>{{.Size}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// DebugHandler returns a handler that serves a page listing all templates of the
+// engine with their origins and sizes, and the source of the template named by
+// the "name" query parameter as plain text. It only serves in development, and
+// responds with 404 otherwise because sources should never be exposed in
+// production.
+func DebugHandler(e *Engine) flamego.Handler {
+	return func(c flamego.Context) {
+		w := c.ResponseWriter()
+		if flamego.Env() != flamego.EnvTypeDev {
+			http.NotFound(w, c.Request().Request)
+			return
+		}
+
+		// Templates loaded from directories are recompiled on every request in
+		// development, do the same so that files added or changed since the engine
+		// was created are listed.
+		set := e.current()
+		if e.opts.Directory != "" || len(e.opts.AppendDirectories) > 0 {
+			var err error
+			set, err = e.recompile()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("template: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if name := c.Query("name"); name != "" {
+			src, ok := set.source(normalizeName(e.opts, name))
+			if !ok {
+				http.NotFound(w, c.Request().Request)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write(src.data)
+			return
+		}
+
+		type entry struct {
+			Name   string
+			Origin string
+			Size   int
+		}
+		srcs := set.sources()
+		templates := make([]entry, 0, len(srcs))
+		var totalBytes int64
+		for _, src := range srcs {
+			templates = append(templates,
+				entry{
+					Name:   src.name,
+					Origin: src.origin,
+					Size:   len(src.data),
+				},
+			)
+			totalBytes += int64(len(src.data))
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := debugPage.Execute(w, map[string]interface{}{
+			"Count":      len(srcs),
+			"TotalBytes": totalBytes,
+			"Templates":  templates,
+		})
+		if err != nil {
+			e.logger.Error("[template] Failed to render debug page", "error", err)
+		}
+	}
+}
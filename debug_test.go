@@ -0,0 +1,119 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/flamego/flamego"
+)
+
+func TestDebugHandler(t *testing.T) {
+	e, err := NewEngine(
+		Options{
+			Directory: "testdata/fragments",
+		},
+	)
+	require.Nil(t, err)
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Get("/debug/templates", DebugHandler(e))
+
+	t.Run("list", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/debug/templates", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+		body := resp.Body.String()
+		assert.Contains(t, body, "3 templates, 92 bytes in total.")
+		assert.Contains(t, body, `<tr><td><a href="?name=header">header</a></td><td>`+filepath.Join("testdata", "fragments", "header.tmpl")+`</td><td>27</td></tr>`)
+	})
+
+	t.Run("source", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/debug/templates?name=header", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+		assert.Equal(t, "<header>{{.Title}}</header>", resp.Body.String())
+	})
+
+	t.Run("unknown template", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/debug/templates?name=404", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("production", func(t *testing.T) {
+		flamego.SetEnv(flamego.EnvTypeProd)
+		defer flamego.SetEnv(flamego.EnvTypeDev)
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/debug/templates", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+		assert.NotContains(t, resp.Body.String(), "header")
+	})
+}
+
+func TestDebugHandler_AddedFile(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "home.tmpl"), []byte("Home"), 0644))
+
+	e, err := NewEngine(
+		Options{
+			Directory: dir,
+		},
+	)
+	require.Nil(t, err)
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Get("/debug/templates", DebugHandler(e))
+
+	// The file is added after the engine has been created.
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "new.tmpl"), []byte("New"), 0644))
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/debug/templates", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	body := resp.Body.String()
+	assert.Contains(t, body, "2 templates, 7 bytes in total.")
+	assert.Contains(t, body, `<a href="?name=new">new</a>`)
+
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/debug/templates?name=new", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "New", resp.Body.String())
+}
@@ -0,0 +1,1176 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"fmt"
+	gotemplate "html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+
+	"github.com/flamego/flamego"
+)
+
+// Engine is a compiled set of templates that is shared by all requests.
+type Engine struct {
+	opts   Options
+	logger *log.Logger
+
+	lock  sync.RWMutex
+	set   *templateSet
+	added map[string]string    // The name to content of templates added at runtime.
+	funcs []gotemplate.FuncMap // The list of functions added by SetFuncs.
+	// generation is incremented whenever added or funcs is changed, which tells a
+	// compilation done without the write lock whether its result is outdated.
+	generation uint64
+
+	inferContentType bool          // Whether to infer content types from extensions
+	trustedProxies   []*net.IPNet  // The parsed list of Options.TrustedProxies
+	renderSem        chan struct{} // The semaphore of Options.MaxConcurrentRenders, if any
+
+	compileLock sync.Mutex
+	compiling   *compileCall // The in-flight recompilation in development
+
+	reloadLock    sync.Mutex
+	reloadChecked time.Time // The last time of checking the checksum
+	checksums     checksums
+	checksum      []byte // The combined checksum of the current set
+}
+
+// compileCall is an in-flight compilation whose result is shared by all callers
+// that arrive before it finishes.
+type compileCall struct {
+	done chan struct{}
+	set  *templateSet
+	err  error
+}
+
+// templateSet is a compiled html/template set along with its text/template
+// counterpart, which is only compiled on first use.
+type templateSet struct {
+	html    *gotemplate.Template
+	layouts map[string]*layout // The name to layout of templates that extend others
+	srcs    []source
+	opts    Options
+
+	textLock sync.Mutex
+	textDone bool
+	text     *texttemplate.Template
+	textErr  error
+	// textFuncs is the list of functions set by Engine.SetFuncs before the
+	// text/template set is compiled.
+	textFuncs []gotemplate.FuncMap
+
+	// proto is the never-executed set that this set is cloned from, which is only
+	// present when functions need to be bound per request or execution (see
+	// usesNesting) because html/template does not allow cloning a template set
+	// once it has been executed.
+	proto *templateSet
+	// funcs is the list of functions bound to this set.
+	funcs gotemplate.FuncMap
+	// pool is the pool of clones with request functions bound, which is only used
+	// on the prototype, see acquire.
+	pool sync.Pool
+	// funcsGen is the generation of functions of the set, which is increased by
+	// setFuncs to tell clones in the pool that are made before.
+	funcsGen uint32
+	// state is the state of the request that the clone is acquired for, which is
+	// only present on clones in the pool of the prototype.
+	state *renderState
+	// gen is the generation of functions of the prototype that the clone is made
+	// with.
+	gen uint32
+	// abandoned indicates whether an execution of the clone has timed out and may
+	// still be running, thus the clone is never put back into the pool.
+	abandoned bool
+	// modTimes is the newest modification time among each template and its
+	// dependencies, which is only present when Options.LastModified is set.
+	modTimes map[string]time.Time
+	// usesNesting indicates whether any template calls the "include" or
+	// "render" functions, which track the depth of nested calls in the state of
+	// pooled clones, thus the set needs a prototype.
+	usesNesting bool
+	// trustedProxies is the parsed list of Options.TrustedProxies.
+	trustedProxies []*net.IPNet
+	// usesRenderDuration indicates whether any template references the
+	// "RenderDuration", which is otherwise not added to the data.
+	usesRenderDuration bool
+	// contentTypes is the content type of templates inferred from their
+	// extensions, which is only present when Options.ContentType is not set.
+	contentTypes map[string]string
+
+	layoutsLock sync.Mutex
+}
+
+// textTemplate returns the text/template set, compiling it on first call.
+func (s *templateSet) textTemplate() (*texttemplate.Template, error) {
+	s.textLock.Lock()
+	defer s.textLock.Unlock()
+
+	if s.textDone {
+		return s.text, s.textErr
+	}
+	s.textDone = true
+
+	// The prototype is its own prototype.
+	if s.proto == nil || s.proto == s {
+		s.text, s.textErr = parseTextTemplate(s.opts, s.srcs)
+		if s.textErr == nil {
+			s.text.Funcs(texttemplate.FuncMap(s.renderFuncs()))
+			for _, funcs := range s.textFuncs {
+				s.text.Funcs(texttemplate.FuncMap(funcs))
+			}
+		}
+		return s.text, s.textErr
+	}
+
+	var text *texttemplate.Template
+	text, s.textErr = s.proto.textTemplate()
+	if s.textErr != nil {
+		return nil, s.textErr
+	}
+	s.text, s.textErr = text.Clone()
+	if s.textErr == nil {
+		s.text.Funcs(texttemplate.FuncMap(s.funcs))
+		s.text.Funcs(texttemplate.FuncMap(s.renderFuncs()))
+		bindTextInclude(s.opts, s.text, s.state)
+	}
+	return s.text, s.textErr
+}
+
+// setFuncs replaces functions of the set in place, including its layouts and
+// the text/template set.
+func (s *templateSet) setFuncs(funcs gotemplate.FuncMap) {
+	s.html.Funcs(funcs)
+
+	s.layoutsLock.Lock()
+	for _, l := range s.layouts {
+		l.tpl.Funcs(funcs)
+	}
+	s.layoutsLock.Unlock()
+
+	s.textLock.Lock()
+	if s.textDone {
+		if s.text != nil {
+			s.text.Funcs(texttemplate.FuncMap(funcs))
+		}
+	} else {
+		s.textFuncs = append(s.textFuncs, funcs)
+	}
+	s.textLock.Unlock()
+
+	atomic.AddUint32(&s.funcsGen, 1)
+}
+
+// layout returns the layout of the named template, or nil if the template does
+// not extend other templates. The layout of a cloned set is cloned from its
+// prototype on first use.
+func (s *templateSet) layout(name string) (*layout, error) {
+	if s.proto == nil {
+		return s.layouts[name], nil
+	}
+
+	s.layoutsLock.Lock()
+	defer s.layoutsLock.Unlock()
+
+	if l, ok := s.layouts[name]; ok {
+		return l, nil
+	}
+
+	proto, ok := s.proto.layouts[name]
+	if !ok {
+		return nil, nil
+	}
+
+	tpl, err := proto.tpl.Clone()
+	if err != nil {
+		return nil, errors.Wrapf(err, "clone layout %q", name)
+	}
+	tpl.Funcs(s.funcs)
+	tpl.Funcs(s.renderFuncs())
+	bindInclude(s.opts, tpl, s.state)
+
+	l := &layout{
+		tpl:  tpl,
+		root: proto.root,
+	}
+	s.layouts[name] = l
+	return l, nil
+}
+
+// execute applies the named template to the data, resolving its layout chain
+// when the template extends other templates.
+func (s *templateSet) execute(w io.Writer, name string, data interface{}) error {
+	if s.proto != nil && s.state == nil {
+		// Only clones acquired from the pool are executed, e.g. by Verify.
+		set, err := s.acquire()
+		if err != nil {
+			return err
+		}
+		defer s.release(set)
+		return set.execute(w, name, data)
+	}
+
+	l, err := s.layout(name)
+	if err != nil {
+		return err
+	} else if l != nil {
+		return l.tpl.ExecuteTemplate(w, l.root, data)
+	}
+	return s.html.ExecuteTemplate(w, name, data)
+}
+
+// has returns true if the named template is defined in the set.
+func (s *templateSet) has(name string) bool {
+	// Layouts of a cloned set are only cloned on first use.
+	layouts := s.layouts
+	if s.proto != nil {
+		layouts = s.proto.layouts
+	}
+	if layouts[name] != nil {
+		return true
+	}
+
+	t := s.html.Lookup(name)
+	return t != nil && t.Tree != nil
+}
+
+// source returns the source of the named template, or false if there is no
+// such template. Later sources overwrite earlier ones with the same name.
+func (s *templateSet) source(name string) (source, bool) {
+	for i := len(s.srcs) - 1; i >= 0; i-- {
+		if s.srcs[i].name == name {
+			return s.srcs[i], true
+		}
+	}
+	return source{}, false
+}
+
+// sources returns the source of each template sorted by name, see source for
+// sources with the same name.
+func (s *templateSet) sources() []source {
+	byName := make(map[string]source, len(s.srcs))
+	for _, src := range s.srcs {
+		byName[src.name] = src
+	}
+	srcs := make([]source, 0, len(byName))
+	for _, src := range byName {
+		srcs = append(srcs, src)
+	}
+	sort.Slice(srcs, func(i, j int) bool { return srcs[i].name < srcs[j].name })
+	return srcs
+}
+
+// manifest returns the sorted list of names of all templates that can be
+// rendered.
+func (s *templateSet) manifest() []string {
+	var names []string
+	for _, t := range s.html.Templates() {
+		// Skip templates that are only declared but never defined, e.g. the root
+		if t.Tree == nil {
+			continue
+		}
+		names = append(names, t.Name())
+	}
+	for name := range s.layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bind returns a clone of the set with given functions bound, and the
+// "include" and "render" functions bound to the state. It must only be called
+// on a set that has a prototype.
+func (s *templateSet) bind(funcs gotemplate.FuncMap, state *renderState) (*templateSet, error) {
+	proto := s.proto
+	tpl, err := proto.html.Clone()
+	if err != nil {
+		return nil, errors.Wrap(err, "clone")
+	}
+	tpl.Funcs(funcs)
+	bindInclude(s.opts, tpl, state)
+
+	set := &templateSet{
+		html:           tpl,
+		layouts:        make(map[string]*layout),
+		srcs:           s.srcs,
+		opts:           s.opts,
+		proto:          proto,
+		funcs:          funcs,
+		state:          state,
+		modTimes:       proto.modTimes,
+		contentTypes:   proto.contentTypes,
+		usesNesting:    proto.usesNesting,
+		trustedProxies: proto.trustedProxies,
+
+		usesRenderDuration: proto.usesRenderDuration,
+	}
+	bindRender(set)
+	return set, nil
+}
+
+// acquire returns a clone of the set with request functions bound to a state of
+// its own, which is taken from the pool of the prototype when available, so
+// that html/template only escapes templates once per clone rather than once per
+// request. The set itself is returned when it has no prototype or is already a
+// clone. The clone should be returned by release once the request is done.
+func (s *templateSet) acquire() (*templateSet, error) {
+	if s.proto == nil || s.state != nil {
+		return s, nil
+	}
+
+	proto := s.proto
+	gen := atomic.LoadUint32(&proto.funcsGen)
+	for {
+		set, ok := proto.pool.Get().(*templateSet)
+		if !ok {
+			break
+		} else if set.gen == gen {
+			return set, nil
+		}
+		// Functions have been replaced by SetFuncs since the clone was made.
+	}
+
+	state := &renderState{}
+	set, err := s.bind(requestFuncs(s.opts, s.trustedProxies, state), state)
+	if err != nil {
+		return nil, err
+	}
+	set.gen = gen
+	return set, nil
+}
+
+// release clears the state of the clone acquired by acquire and puts it back
+// into the pool of the prototype.
+func (s *templateSet) release(set *templateSet) {
+	if set == s || set.abandoned {
+		return
+	}
+
+	*set.state = renderState{}
+	if set.gen == atomic.LoadUint32(&s.proto.funcsGen) {
+		s.proto.pool.Put(set)
+	}
+}
+
+// NewEngine compiles templates with given options and returns a reusable
+// Engine.
+func NewEngine(opts ...Options) (*Engine, error) {
+	var opt Options
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	trustedProxies, err := parseTrustedProxies(opt.TrustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse trusted proxies")
+	}
+
+	parseOptions := func(opts Options) Options {
+		if opts.Directory == "" {
+			opts.Directory = "templates"
+		}
+
+		if len(opts.Extensions) == 0 {
+			opts.Extensions = []string{".tmpl", ".html"}
+		}
+
+		if opts.ContentType == "" {
+			opts.ContentType = "text/html"
+		}
+
+		if opts.CSRFFieldName == "" {
+			opts.CSRFFieldName = "_csrf"
+		}
+
+		if opts.FragmentCache == nil {
+			opts.FragmentCache = NewMemoryFragmentCache()
+		}
+
+		if opts.BindingErrorsKey == "" {
+			opts.BindingErrorsKey = "Errors"
+		}
+
+		if opts.BufferPool == nil {
+			opts.BufferPool = newSyncBufferPool()
+		}
+
+		if opts.StripHTMLComments {
+			// Copy to not share the backing array with the caller.
+			opts.PostProcessors = append(
+				append([]func(string, []byte) ([]byte, error)(nil), opts.PostProcessors...),
+				stripHTMLComments,
+			)
+		}
+		return opts
+	}
+
+	e := &Engine{
+		opts:   parseOptions(opt),
+		logger: log.Default().WithPrefix("template"),
+		added:  make(map[string]string),
+
+		inferContentType: opt.ContentType == "",
+		trustedProxies:   trustedProxies,
+	}
+	if opt.MaxConcurrentRenders > 0 {
+		e.renderSem = make(chan struct{}, opt.MaxConcurrentRenders)
+	}
+
+	if e.opts.ReloadOnChecksum {
+		// Computed before compiling so that changes during compiling are picked up by
+		// the next check.
+		e.checksum, err = e.checksums.sum(e.opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "checksum")
+		}
+		e.reloadChecked = time.Now()
+	}
+
+	e.set, err = e.compile()
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// compileOptions returns the options to compile templates with, which has
+// functions added by SetFuncs appended to Options.FuncMaps. The options of the
+// engine are never modified after NewEngine, thus they are safe to be read by
+// requests without the lock.
+func (e *Engine) compileOptions() Options {
+	opt := e.opts
+	if len(e.funcs) > 0 {
+		// Copy to not modify the backing array of the user's slice.
+		opt.FuncMaps = append(append([]gotemplate.FuncMap(nil), opt.FuncMaps...), e.funcs...)
+	}
+	return opt
+}
+
+// compile builds a new template set from the configured sources and templates
+// added at runtime.
+func (e *Engine) compile() (*templateSet, error) {
+	opt := e.compileOptions()
+	srcs, err := loadSources(opt, e.logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "new template")
+	}
+
+	names := make([]string, 0, len(e.added))
+	for name := range e.added {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		srcs = append(srcs,
+			source{
+				name:   name,
+				origin: "runtime:" + name,
+				data:   []byte(e.added[name]),
+			},
+		)
+	}
+
+	tpl, err := parseTemplate(opt, srcs)
+	if err != nil {
+		return nil, errors.Wrap(err, "new template")
+	}
+
+	layouts, err := parseLayouts(opt, tpl, srcs)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse layouts")
+	}
+
+	set := &templateSet{
+		html:    tpl,
+		layouts: layouts,
+		srcs:    srcs,
+		opts:    opt,
+
+		trustedProxies: e.trustedProxies,
+	}
+	if opt.CheckReferences {
+		err = checkReferences(set)
+		if err != nil {
+			return nil, errors.Wrap(err, "check references")
+		}
+	}
+	if opt.LastModified {
+		set.modTimes = modTimes(set)
+	}
+	if e.inferContentType {
+		set.contentTypes = contentTypes(srcs)
+	}
+	for _, src := range srcs {
+		if bytes.Contains(src.data, []byte("RenderDuration")) {
+			set.usesRenderDuration = true
+		}
+	}
+	set.usesNesting = setCallsNested(set)
+	return bindPrototype(opt, set)
+}
+
+// bindPrototype returns the set as-is if no function needs to be bound per
+// request or execution. Otherwise, it keeps the set as the prototype, and
+// returns a clone of it as the shared set so that the prototype is never
+// executed.
+func bindPrototype(opts Options, set *templateSet) (*templateSet, error) {
+	if !hasRequestFuncs(opts) && !set.usesNesting {
+		return set, nil
+	}
+
+	set.proto = set
+	return set.bind(requestFuncs(opts, nil, nil), nil)
+}
+
+// clone returns a copy of the set that is cloned from its prototype, or the set
+// itself when there is no prototype. It returns an error if the set to clone
+// from has been executed.
+func (s *templateSet) clone(opts Options) (*templateSet, error) {
+	base := s
+	if s.proto != nil {
+		base = s.proto
+	}
+
+	tpl, err := base.html.Clone()
+	if err != nil {
+		return nil, errors.Wrap(err, "clone")
+	}
+	// The "include" function is bound to the set it is cloned from.
+	bindInclude(opts, tpl, nil)
+
+	layouts := make(map[string]*layout, len(base.layouts))
+	for name, l := range base.layouts {
+		ltpl, err := l.tpl.Clone()
+		if err != nil {
+			return nil, errors.Wrapf(err, "clone layout %q", name)
+		}
+		bindInclude(opts, ltpl, nil)
+		layouts[name] = &layout{
+			tpl:  ltpl,
+			root: l.root,
+		}
+	}
+
+	return &templateSet{
+		html:           tpl,
+		layouts:        layouts,
+		srcs:           append([]source(nil), base.srcs...),
+		opts:           opts,
+		modTimes:       base.modTimes,
+		contentTypes:   base.contentTypes,
+		usesNesting:    base.usesNesting,
+		trustedProxies: base.trustedProxies,
+
+		usesRenderDuration: base.usesRenderDuration,
+	}, nil
+}
+
+// contentTypes returns the content type of each template that is inferred from
+// its extension, skipping ".tmpl", ".html" and unknown extensions.
+func contentTypes(srcs []source) map[string]string {
+	types := make(map[string]string)
+	for _, src := range srcs {
+		ext := filepath.Ext(src.ext)
+		if ext == "" || ext == ".tmpl" || ext == ".html" {
+			continue
+		}
+
+		mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+		if err != nil {
+			continue
+		}
+		types[src.name] = mediaType
+	}
+	return types
+}
+
+// recompile compiles a new template set for development, concurrent calls share
+// the result of the in-flight compilation instead of compiling in parallel.
+func (e *Engine) recompile() (*templateSet, error) {
+	e.compileLock.Lock()
+	if call := e.compiling; call != nil {
+		e.compileLock.Unlock()
+		<-call.done
+		return call.set, call.err
+	}
+	call := &compileCall{done: make(chan struct{})}
+	e.compiling = call
+	e.compileLock.Unlock()
+
+	e.lock.RLock()
+	call.set, call.err = e.compile()
+	e.lock.RUnlock()
+
+	e.compileLock.Lock()
+	e.compiling = nil
+	e.compileLock.Unlock()
+	close(call.done)
+	return call.set, call.err
+}
+
+// current returns the current compiled template set.
+func (e *Engine) current() *templateSet {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.set
+}
+
+// template returns the current compiled html/template set.
+func (e *Engine) template() *gotemplate.Template {
+	return e.current().html
+}
+
+// AddTemplate parses the content and registers it as the named template,
+// replacing any existing template with the same name.
+//
+// The template is parsed into a clone of the compiled templates when possible,
+// i.e. they have not been executed (always the case when functions are bound
+// per request or templates call the "include" or "render" functions, or right
+// after Clone), and no template extends others.
+// Otherwise, because html/template does not allow parsing into a template set
+// once it has been executed, the whole set is recompiled from its sources
+// (including reading files from disk), which is relatively expensive and should
+// not be done on every request.
+func (e *Engine) AddTemplate(name, content string) error {
+	name = normalizeName(e.opts, name)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	cloned, ok, err := e.parseIntoClone(name, content)
+	if err != nil {
+		return err
+	} else if ok {
+		e.added[name] = content
+		e.set = cloned
+		e.generation++
+		return nil
+	}
+
+	prev, existed := e.added[name]
+	e.added[name] = content
+	set, err := e.compile()
+	if err != nil {
+		if existed {
+			e.added[name] = prev
+		} else {
+			delete(e.added, name)
+		}
+		return err
+	}
+	e.set = set
+	e.generation++
+	return nil
+}
+
+// SetFuncs adds the functions to the compiled templates, replacing existing
+// ones with the same names, without recompiling. Because functions are looked
+// up by name when templates are executed, replacing the implementation of a
+// function takes effect immediately for subsequent renders. However, templates
+// are only able to reference functions that exist when they are parsed, thus a
+// new function is only usable by templates compiled afterwards, e.g. by
+// AddTemplate or in development. Request-scoped functions like "csrfToken"
+// cannot be replaced.
+func (e *Engine) SetFuncs(funcs gotemplate.FuncMap) error {
+	err := validateFuncs(funcs)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.funcs = append(e.funcs, funcs)
+	e.generation++
+	e.set.setFuncs(funcs)
+	if e.set.proto != nil {
+		e.set.proto.setFuncs(funcs)
+	}
+	return nil
+}
+
+// parseIntoClone parses the content as the named template into a clone of the
+// current set. It returns false if it is not possible, and the set needs to be
+// recompiled.
+func (e *Engine) parseIntoClone(name, content string) (*templateSet, bool, error) {
+	// Layouts and options that depend on the whole set need a recompilation.
+	if len(e.set.layouts) > 0 || (e.set.proto != nil && len(e.set.proto.layouts) > 0) ||
+		e.opts.LastModified || e.opts.CheckReferences {
+		return nil, false, nil
+	}
+
+	delims, data := splitDelims([]byte(content), e.opts.Delims)
+	if parent, _ := splitExtends(data, delims); parent != "" {
+		return nil, false, nil
+	}
+
+	opts := e.compileOptions()
+	set, err := e.set.clone(opts)
+	if err != nil {
+		// The set has been executed.
+		return nil, false, nil
+	}
+
+	_, err = set.html.New(name).Delims(delims.Left, delims.Right).Parse(string(data))
+	if err != nil {
+		return nil, false, errors.Wrap(newParseError(name, err), "new template")
+	}
+	set.srcs = append(set.srcs,
+		source{
+			name:   name,
+			origin: "runtime:" + name,
+			data:   []byte(content),
+		},
+	)
+	if bytes.Contains(set.srcs[len(set.srcs)-1].data, []byte("RenderDuration")) {
+		set.usesRenderDuration = true
+	}
+	if !set.usesNesting {
+		set.usesNesting = setCallsNested(set)
+	}
+
+	set, err = bindPrototype(opts, set)
+	if err != nil {
+		return nil, false, err
+	}
+	return set, true, nil
+}
+
+// Clone returns a copy of the engine with its compiled templates cloned, which
+// is cheaper than NewEngine for variants of the engine, e.g. per tenant, that
+// override some templates by AddTemplate or functions by SetFuncs without
+// affecting the engine. Because html/template does not allow cloning a template
+// set once it has been executed, Clone must be called before any execution on
+// the engine unless functions are bound per request (e.g. Options.CSRFTokenFunc
+// is set) or templates call the "include" or "render" functions.
+func (e *Engine) Clone() (*Engine, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	opts := e.compileOptions()
+	set, err := e.set.clone(opts)
+	if err != nil {
+		return nil, err
+	}
+	set, err = bindPrototype(opts, set)
+	if err != nil {
+		return nil, errors.Wrap(err, "bind")
+	}
+
+	added := make(map[string]string, len(e.added))
+	for name, content := range e.added {
+		added[name] = content
+	}
+	return &Engine{
+		opts:   e.opts,
+		logger: e.logger,
+		set:    set,
+		added:  added,
+		// Copy to not share the backing array with the engine.
+		funcs: append([]gotemplate.FuncMap(nil), e.funcs...),
+
+		inferContentType: e.inferContentType,
+		trustedProxies:   e.trustedProxies,
+		// Shared to bound the renders of the engine and its clones together.
+		renderSem: e.renderSem,
+	}, nil
+}
+
+// RemoveTemplate removes the named template that was previously added by
+// AddTemplate. It returns an error if no such template was added.
+//
+// Because html/template does not support removing a parsed template, the whole
+// set is recompiled from its sources (including reading files from disk), which
+// has the same cost as AddTemplate.
+func (e *Engine) RemoveTemplate(name string) error {
+	name = normalizeName(e.opts, name)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	content, ok := e.added[name]
+	if !ok {
+		return errors.Errorf("template %q was not added at runtime", name)
+	}
+
+	delete(e.added, name)
+	set, err := e.compile()
+	if err != nil {
+		e.added[name] = content
+		return err
+	}
+	e.set = set
+	e.generation++
+	return nil
+}
+
+// warmBufferSize is the capacity of each buffer put into the pool by Warm.
+const warmBufferSize = 4 << 10
+
+// Warm puts n buffers into the buffer pool, which reduces allocations of the
+// first requests after startup. Note that the default pool may still drop the
+// buffers at any garbage collection. No buffer is preloaded when
+// Options.DisableBufferPool is set.
+func (e *Engine) Warm(n int) {
+	if e.opts.DisableBufferPool {
+		n = 0
+	}
+
+	size := warmBufferSize
+	if e.opts.MaxBufferSize > 0 && e.opts.MaxBufferSize < size {
+		size = e.opts.MaxBufferSize
+	}
+
+	bufs := make([]*bytes.Buffer, 0, n)
+	for i := 0; i < n; i++ {
+		buf := e.opts.BufferPool.Get()
+		buf.Grow(size)
+		bufs = append(bufs, buf)
+	}
+	for _, buf := range bufs {
+		buf.Reset()
+		e.opts.BufferPool.Put(buf)
+	}
+}
+
+// Manifest returns the sorted list of names of all templates that can be
+// rendered, including those defined by the "define" and "block" actions.
+func (e *Engine) Manifest() []string {
+	return e.current().manifest()
+}
+
+// Validate compiles templates with given options and executes every template
+// with the sample data, which is meant to be run at build time (e.g. in a test
+// or a small command in CI) to catch broken templates before deploying.
+func Validate(opts Options, sampleData Data) error {
+	e, err := NewEngine(opts)
+	if err != nil {
+		return err
+	}
+	return e.Verify(sampleData)
+}
+
+// Verify executes every template with the sample data and returns errors of
+// all templates that failed to execute, which is useful for catching errors
+// like calling an undefined method or accessing a nonexistent field of a struct
+// before serving requests. Note that accessing a missing key of a map is not
+// an error by default.
+func (e *Engine) Verify(sampleData Data) error {
+	set := e.current()
+
+	var errs multiError
+	for _, name := range set.manifest() {
+		err := set.execute(io.Discard, name, sampleData)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "execute %q", name))
+		}
+	}
+	return errs.err()
+}
+
+// Source returns the source of the named template as loaded at compile time,
+// or false if there is no such template.
+func (e *Engine) Source(name string) ([]byte, bool) {
+	set := e.current()
+	name = normalizeName(e.opts, name)
+
+	src, ok := set.source(name)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), src.data...), true
+}
+
+// HasTemplate returns true if the named template exists, including those
+// defined by the "define" and "block" actions.
+func (e *Engine) HasTemplate(name string) bool {
+	return e.current().has(normalizeName(e.opts, name))
+}
+
+// TemplateSource returns the human-readable origin of the named template, e.g.
+// the path on disk or "embed:templates/home.tmpl", or false if there is no
+// such template.
+func (e *Engine) TemplateSource(name string) (source string, ok bool) {
+	set := e.current()
+	name = normalizeName(e.opts, name)
+
+	src, ok := set.source(name)
+	if !ok {
+		return "", false
+	}
+	return src.origin, true
+}
+
+// Stats returns the number of compiled templates and the total size in bytes of
+// their sources.
+func (e *Engine) Stats() (count int, totalBytes int64) {
+	srcs := e.current().sources()
+	for _, src := range srcs {
+		totalBytes += int64(len(src.data))
+	}
+	return len(srcs), totalBytes
+}
+
+// RenderEmail renders the named HTML template and the named text template with
+// the data, which are the HTML and plain text parts of a multipart email. The
+// text template is rendered without escaping.
+func (e *Engine) RenderEmail(htmlName, textName string, data Data) (html string, text string, err error) {
+	shared := e.current()
+	set, err := shared.acquire()
+	if err != nil {
+		return "", "", err
+	}
+	defer shared.release(set)
+
+	htmlName = normalizeName(e.opts, htmlName)
+	textName = normalizeName(e.opts, textName)
+
+	var buf bytes.Buffer
+	err = set.execute(&buf, htmlName, data)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "execute %q", htmlName)
+	}
+	html = buf.String()
+
+	tpl, err := set.textTemplate()
+	if err != nil {
+		return "", "", errors.Wrap(err, "text template")
+	}
+
+	buf.Reset()
+	err = tpl.ExecuteTemplate(&buf, textName, data)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "execute %q", textName)
+	}
+	return html, buf.String(), nil
+}
+
+// RenderAll renders every template loaded from sources with the data, except
+// partials named with Options.PartialPrefix, and returns the output of each
+// template by its name, which is useful for generating static sites or
+// sitemaps. Templates defined by the "define" and "block" actions are not
+// rendered on their own. Errors of all templates that failed to render are
+// returned together.
+func (e *Engine) RenderAll(data Data) (map[string][]byte, error) {
+	set := e.current()
+
+	outputs := make(map[string][]byte, len(set.srcs))
+	seen := make(map[string]bool, len(set.srcs))
+	var errs multiError
+	for _, src := range set.srcs {
+		if seen[src.name] {
+			continue
+		}
+		seen[src.name] = true
+
+		if e.opts.PartialPrefix != "" &&
+			strings.HasPrefix(path.Base(src.name), e.opts.PartialPrefix) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		err := set.execute(&buf, src.name, data)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "execute %q", src.name))
+			continue
+		}
+		outputs[src.name] = buf.Bytes()
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// RenderForTest compiles templates with given options and renders the named
+// template with the data once without involving HTTP, which is useful for
+// testing templates in isolation, e.g. comparing against golden files.
+func RenderForTest(opts Options, name string, data Data) (string, error) {
+	e, err := NewEngine(opts)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = e.current().execute(&buf, normalizeName(e.opts, name), data)
+	if err != nil {
+		return "", errors.Wrapf(err, "execute %q", name)
+	}
+	return buf.String(), nil
+}
+
+// multiError is a list of errors that are reported together.
+type multiError []error
+
+// err returns nil if there is no error in the list, or the error itself if
+// there is only one.
+func (errs multiError) err() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+func (errs multiError) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the errors in the list, which are inspected by errors.Is and
+// errors.As since Go 1.20.
+func (errs multiError) Unwrap() []error {
+	return errs
+}
+
+// Is reports whether any error in the list matches the target, for versions of
+// Go before 1.20 that do not inspect the result of Unwrap.
+func (errs multiError) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error in the list that matches the target, for versions of
+// Go before 1.20 that do not inspect the result of Unwrap.
+func (errs multiError) As(target interface{}) bool {
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns a middleware handler that injects template.Templater,
+// template.Data and *template.SafeData into the request context using the
+// engine. See Templater for details.
+func (e *Engine) Handler() flamego.Handler {
+	opt := e.opts
+	renderSizes := &sync.Map{}
+	pageCalls := &pageCalls{}
+
+	return flamego.LoggerInvoker(func(c flamego.Context, logger *log.Logger) {
+		set := e.current()
+		if flamego.Env() == flamego.EnvTypeDev &&
+			(opt.Directory != "" || len(opt.AppendDirectories) > 0) {
+			var err error
+			set, err = e.recompile()
+			if err != nil {
+				http.Error(
+					c.ResponseWriter(),
+					fmt.Sprintf("template: %v", err),
+					http.StatusInternalServerError,
+				)
+				return
+			}
+		} else if opt.ReloadOnChecksum {
+			var err error
+			set, err = e.reloadIfChanged()
+			if err != nil {
+				logger.Error("Failed to reload templates", "error", err)
+			}
+		}
+
+		data := make(Data)
+		t := &template{
+			c:              c,
+			responseWriter: c.ResponseWriter(),
+			request:        c.Request().Request,
+			logger:         logger.WithPrefix("template"),
+			Template:       set.html,
+			Data:           data,
+			safeData:       &SafeData{data: data},
+			opts:           &e.opts,
+			set:            set,
+			contentType:    opt.ContentType,
+			bufPool:        opt.BufferPool,
+			renderSizes:    renderSizes,
+			pageCalls:      pageCalls,
+			renderSem:      e.renderSem,
+		}
+
+		var bound *templateSet
+		if set.proto != nil {
+			var err error
+			bound, err = set.acquire()
+			if err != nil {
+				http.Error(
+					c.ResponseWriter(),
+					fmt.Sprintf("template: bind request functions: %v", err),
+					http.StatusInternalServerError,
+				)
+				return
+			}
+			defer set.release(bound)
+
+			bound.state.c = c
+			bound.state.t = t
+			t.Template = bound.html
+			t.set = bound
+		}
+
+		if opt.InjectRequest {
+			t.Data["Request"] = c.Request().Request
+		}
+
+		if opt.FlashFunc != nil {
+			if flash := opt.FlashFunc(c); flash != nil {
+				t.Data["Flash"] = flash
+			}
+		}
+
+		for _, init := range opt.DataInitializers {
+			init(c, t.Data)
+		}
+
+		if opt.CSPNonce {
+			var err error
+			t.cspNonce, err = newNonce()
+			if err != nil {
+				http.Error(
+					c.ResponseWriter(),
+					fmt.Sprintf("template: new CSP nonce: %v", err),
+					http.StatusInternalServerError,
+				)
+				return
+			}
+			t.Data["CSPNonce"] = t.cspNonce
+		}
+
+		c.MapTo(t, (*Template)(nil))
+		c.Map(t.Data)
+		c.Map(t.safeData)
+
+		if bound != nil {
+			// The clone is only released after the rest of handlers are done.
+			c.Next()
+		}
+	})
+}
@@ -0,0 +1,648 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	gotemplate "html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/flamego/flamego"
+)
+
+func TestEngine_AddTemplate(t *testing.T) {
+	e, err := NewEngine(
+		Options{
+			Directory: "testdata/basic",
+			FuncMaps: []gotemplate.FuncMap{
+				{"Year": func() int { return 2021 }},
+			},
+		},
+	)
+	require.Nil(t, err)
+
+	render := func(name string) (int, string) {
+		f := flamego.NewWithLogger(&bytes.Buffer{})
+		f.Use(e.Handler())
+		f.Get("/", func(t Template, data Data) {
+			data["Name"] = "Flamego"
+			t.HTML(http.StatusOK, name)
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+		return resp.Code, resp.Body.String()
+	}
+
+	err = e.AddTemplate("plugin/greeting", `Hi, {{.Name}}! {{Year}}`)
+	require.Nil(t, err)
+
+	code, body := render("plugin/greeting")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Hi, Flamego! 2021", body)
+
+	// Overwrite an existing template
+	err = e.AddTemplate("base/head", `<header>Plugin header</header>`)
+	require.Nil(t, err)
+
+	code, body = render("home")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "<header>Plugin header</header>")
+
+	// A template that fails to parse leaves the engine untouched
+	err = e.AddTemplate("plugin/broken", `{{.Name`)
+	assert.NotNil(t, err)
+
+	code, _ = render("plugin/greeting")
+	assert.Equal(t, http.StatusOK, code)
+
+	err = e.RemoveTemplate("plugin/greeting")
+	require.Nil(t, err)
+
+	code, _ = render("plugin/greeting")
+	assert.Equal(t, http.StatusInternalServerError, code)
+
+	err = e.RemoveTemplate("plugin/greeting")
+	assert.NotNil(t, err)
+}
+
+func TestEngine_Verify(t *testing.T) {
+	type user struct {
+		Name string
+	}
+
+	e, err := NewEngine(Options{Directory: "testdata/verify"})
+	require.Nil(t, err)
+
+	err = e.Verify(Data{"User": user{Name: "Flamego"}})
+	require.NotNil(t, err)
+
+	// Both broken templates are reported
+	got := err.Error()
+	assert.Contains(t, got, `execute "greeting"`)
+	assert.Contains(t, got, `execute "title"`)
+	assert.NotContains(t, got, `execute "name"`)
+}
+
+func TestRenderForTest(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		template string
+		data     Data
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "func maps",
+			opts:     Options{Directory: "testdata/basic", FuncMaps: []gotemplate.FuncMap{{"Year": func() int { return 2021 }}}},
+			template: "home",
+			data:     Data{"Name": "Joe"},
+			want:     "\n<header>This is a header</header>\n<p>\n  Hello, Joe!\n</p>\n<footer>2021</footer>\n",
+		},
+		{
+			name: "file system and delims",
+			opts: Options{
+				FileSystem: &memoryFileSystem{NewFile("home", []byte("<p>[[.Name]]</p>"), ".tmpl")},
+				Delims:     Delims{Left: "[[", Right: "]]"},
+			},
+			template: "home",
+			data:     Data{"Name": "Joe"},
+			want:     "<p>Joe</p>",
+		},
+		{
+			name:     "layouts",
+			opts:     Options{Directory: "testdata/layouts/valid"},
+			template: "page",
+			data:     Data{"Name": "Joe"},
+			want:     "<html><section>Hello, Joe!</section></html>\n",
+		},
+		{
+			name:     "missing template",
+			opts:     Options{Directory: "testdata/fragments"},
+			template: "404",
+			wantErr:  `execute "404": html/template: "404" is undefined`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := RenderForTest(test.opts, test.template, test.data)
+			if test.wantErr != "" {
+				require.NotNil(t, err)
+				assert.Equal(t, test.wantErr, err.Error())
+				return
+			}
+			require.Nil(t, err)
+
+			want := test.want
+			if runtime.GOOS == "windows" {
+				want = strings.ReplaceAll(want, "\n", "\r\n")
+			}
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestEngine_Stats(t *testing.T) {
+	e, err := NewEngine(
+		Options{
+			Directory: "testdata/fragments",
+		},
+	)
+	require.Nil(t, err)
+
+	count, totalBytes := e.Stats()
+	assert.Equal(t, 3, count)
+	assert.Equal(t, int64(30+35+27), totalBytes)
+
+	require.Nil(t, e.AddTemplate("footer", "<footer></footer>"))
+	count, totalBytes = e.Stats()
+	assert.Equal(t, 4, count)
+	assert.Equal(t, int64(30+35+27+17), totalBytes)
+
+	// Overwriting an existing template should not be counted twice.
+	require.Nil(t, e.AddTemplate("header", "<header></header>"))
+	count, totalBytes = e.Stats()
+	assert.Equal(t, 4, count)
+	assert.Equal(t, int64(30+35+17+17), totalBytes)
+}
+
+func TestEngine_RenderAll(t *testing.T) {
+	e, err := NewEngine(
+		Options{
+			Directory:     "testdata/sitemap",
+			PartialPrefix: "_",
+		},
+	)
+	require.Nil(t, err)
+
+	got, err := e.RenderAll(Data{"Site": "Flamego"})
+	require.Nil(t, err)
+
+	want := map[string][]byte{
+		"about": []byte("<html><h1>About</h1><footer>Flamego</footer></html>"),
+		"index": []byte("<html><h1>Home</h1><footer>Flamego</footer></html>"),
+	}
+	assert.Equal(t, want, got)
+
+	t.Run("error", func(t *testing.T) {
+		require.Nil(t, e.AddTemplate("broken", `{{template "404"}}`))
+
+		_, err := e.RenderAll(Data{"Site": "Flamego"})
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), `execute "broken"`)
+	})
+}
+
+func TestEngine_Manifest(t *testing.T) {
+	e, err := NewEngine(Options{Directory: "testdata/layouts/valid"})
+	require.Nil(t, err)
+
+	want := []string{"about", "base", "content", "page", "section"}
+	assert.Equal(t, want, e.Manifest())
+}
+
+func TestTemplateSet_Has(t *testing.T) {
+	for _, opts := range []Options{
+		{Directory: "testdata/layouts/valid"},
+		{
+			Directory:     "testdata/layouts/valid",
+			CSRFTokenFunc: func(c flamego.Context) string { return "" },
+		},
+	} {
+		e, err := NewEngine(opts)
+		require.Nil(t, err)
+
+		set := e.current()
+		assert.True(t, set.has("base"))
+		assert.True(t, set.has("page"))
+		assert.True(t, set.has("content"))
+		assert.False(t, set.has("404"))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	type user struct {
+		Name string
+	}
+
+	err := Validate(Options{Directory: "testdata/layouts/valid"}, Data{"Name": "Flamego"})
+	assert.Nil(t, err)
+
+	err = Validate(Options{Directory: "testdata/verify"}, Data{"User": user{Name: "Flamego"}})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `execute "greeting"`)
+
+	err = Validate(Options{Directory: "testdata/broken"}, nil)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `parse "home"`)
+}
+
+func TestEngine_recompile(t *testing.T) {
+	var (
+		compiles int32
+		release  = make(chan struct{})
+	)
+	e, err := NewEngine(
+		Options{
+			Directory: "testdata/fragments",
+			EnvFilter: func(name string) bool {
+				if name == "body" && atomic.AddInt32(&compiles, 1) > 1 {
+					<-release
+				}
+				return true
+			},
+		},
+	)
+	require.Nil(t, err)
+
+	var wg sync.WaitGroup
+	sets := make([]*templateSet, 10)
+	for i := range sets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			sets[i], err = e.recompile()
+			assert.Nil(t, err)
+		}(i)
+	}
+
+	// Give all calls a chance to join the blocked compilation.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// One for NewEngine, and one shared by all concurrent calls.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&compiles))
+	for _, set := range sets {
+		assert.True(t, set == sets[0])
+	}
+
+	// Later calls compile again to pick up changes.
+	_, err = e.recompile()
+	require.Nil(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&compiles))
+}
+
+func TestEngine_RenderEmail(t *testing.T) {
+	e, err := NewEngine(
+		Options{
+			Directory: "testdata/email",
+		},
+	)
+	require.Nil(t, err)
+
+	html, text, err := e.RenderEmail("welcome", "welcome.txt", Data{"Name": "<Joe>"})
+	require.Nil(t, err)
+	assert.Equal(t, "<p>Welcome, &lt;Joe&gt;!</p>", html)
+	assert.Equal(t, "Welcome, <Joe>!", text)
+
+	_, _, err = e.RenderEmail("welcome", "404", nil)
+	assert.NotNil(t, err)
+}
+
+func TestEngine_Source(t *testing.T) {
+	e, err := NewEngine(
+		Options{
+			Directory:         "testdata/overwrite/primary",
+			AppendDirectories: []string{"testdata/overwrite/append"},
+		},
+	)
+	require.Nil(t, err)
+
+	want, err := os.ReadFile("testdata/overwrite/append/head.tmpl")
+	require.Nil(t, err)
+
+	got, ok := e.Source("head")
+	assert.True(t, ok)
+	assert.Equal(t, string(want), string(got))
+
+	require.Nil(t, e.AddTemplate("runtime", "<p>Runtime</p>"))
+	got, ok = e.Source("runtime")
+	assert.True(t, ok)
+	assert.Equal(t, "<p>Runtime</p>", string(got))
+
+	_, ok = e.Source("404")
+	assert.False(t, ok)
+}
+
+func TestEngine_TemplateSource(t *testing.T) {
+	e, err := NewEngine(
+		Options{
+			Directory:         "testdata/overwrite/primary",
+			AppendDirectories: []string{"testdata/overwrite/append"},
+		},
+	)
+	require.Nil(t, err)
+	require.Nil(t, e.AddTemplate("runtime", "<p>Runtime</p>"))
+
+	tests := []struct {
+		name       string
+		wantSource string
+		wantOK     bool
+	}{
+		{name: "home", wantSource: filepath.Join("testdata", "overwrite", "primary", "home.tmpl"), wantOK: true},
+		{name: "head", wantSource: filepath.Join("testdata", "overwrite", "append", "head.tmpl"), wantOK: true},
+		{name: "runtime", wantSource: "runtime:runtime", wantOK: true},
+		{name: "404"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, ok := e.TemplateSource(test.name)
+			assert.Equal(t, test.wantSource, source)
+			assert.Equal(t, test.wantOK, ok)
+		})
+	}
+
+	fs, err := EmbedFS(primaryTemplates, "testdata/overwrite/primary", []string{".tmpl"})
+	require.Nil(t, err)
+	e, err = NewEngine(Options{FileSystem: fs})
+	require.Nil(t, err)
+
+	source, ok := e.TemplateSource("home")
+	assert.True(t, ok)
+	assert.Equal(t, "embed:testdata/overwrite/primary/home.tmpl", source)
+}
+
+func TestEngine_SetFuncs(t *testing.T) {
+	newEngine := func(t *testing.T) *Engine {
+		e, err := NewEngine(
+			Options{
+				Directory: "testdata/setfuncs",
+				FuncMaps: []gotemplate.FuncMap{
+					{"greet": func(name string) string { return "Hello, " + name }},
+				},
+				CSRFTokenFunc: func(c flamego.Context) string { return "token" },
+			},
+		)
+		require.Nil(t, err)
+		return e
+	}
+	hi := gotemplate.FuncMap{"greet": func(name string) string { return "Hi, " + name }}
+
+	t.Run("compiled text template", func(t *testing.T) {
+		e := newEngine(t)
+		html, text, err := e.RenderEmail("page", "greet", Data{"Name": "Joe"})
+		require.Nil(t, err)
+		assert.Equal(t, "<html>Hello, Joe</html>", html)
+		assert.Equal(t, "<p>Hello, Joe</p>", text)
+
+		require.Nil(t, e.SetFuncs(hi))
+
+		html, text, err = e.RenderEmail("page", "greet", Data{"Name": "Joe"})
+		require.Nil(t, err)
+		assert.Equal(t, "<html>Hi, Joe</html>", html)
+		assert.Equal(t, "<p>Hi, Joe</p>", text)
+	})
+
+	t.Run("uncompiled text template", func(t *testing.T) {
+		e := newEngine(t)
+		require.Nil(t, e.SetFuncs(hi))
+
+		html, text, err := e.RenderEmail("page", "greet", Data{"Name": "Joe"})
+		require.Nil(t, err)
+		assert.Equal(t, "<html>Hi, Joe</html>", html)
+		assert.Equal(t, "<p>Hi, Joe</p>", text)
+	})
+
+	t.Run("request", func(t *testing.T) {
+		e := newEngine(t)
+
+		f := flamego.NewWithLogger(&bytes.Buffer{})
+		f.Use(e.Handler())
+		f.Get("/", func(t Template, data Data) {
+			data["Name"] = "Joe"
+			t.HTML(http.StatusOK, "page")
+		})
+
+		flamego.SetEnv(flamego.EnvTypeProd)
+		defer flamego.SetEnv(flamego.EnvTypeDev)
+
+		render := func() string {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+			return resp.Body.String()
+		}
+		assert.Equal(t, "<html>Hello, Joe</html>", render())
+
+		// Clones in the pool made before are not reused.
+		require.Nil(t, e.SetFuncs(hi))
+		assert.Equal(t, "<html>Hi, Joe</html>", render())
+	})
+
+	t.Run("recompile", func(t *testing.T) {
+		e := newEngine(t)
+		require.Nil(t, e.SetFuncs(gotemplate.FuncMap{"shout": strings.ToUpper}))
+		require.Nil(t, e.AddTemplate("shout", `{{shout .Name}}`))
+
+		got, _, err := e.RenderEmail("shout", "greet", Data{"Name": "Joe"})
+		require.Nil(t, err)
+		assert.Equal(t, "JOE", got)
+
+		// Options read by requests without the lock are never modified.
+		assert.Len(t, e.opts.FuncMaps, 1)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		e := newEngine(t)
+		err := e.SetFuncs(gotemplate.FuncMap{"greet": "not a function"})
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "invalid functions")
+	})
+}
+
+func TestEngine_Clone(t *testing.T) {
+	render := func(t *testing.T, e *Engine, name string) string {
+		var buf bytes.Buffer
+		err := e.current().execute(&buf, name, Data{"Title": "Flamego", "Name": "Joe"})
+		require.Nil(t, err)
+		return buf.String()
+	}
+
+	t.Run("override", func(t *testing.T) {
+		e, err := NewEngine(
+			Options{
+				Directory: "testdata/fragments",
+				FuncMaps: []gotemplate.FuncMap{
+					{"greet": func() string { return "Hello" }},
+				},
+			},
+		)
+		require.Nil(t, err)
+
+		tenant, err := e.Clone()
+		require.Nil(t, err)
+		require.Nil(t, tenant.AddTemplate("header", `<header>{{greet}}, {{.Title}}</header>`))
+		require.Nil(t, tenant.SetFuncs(gotemplate.FuncMap{"greet": func() string { return "Hi" }}))
+
+		assert.Equal(t, "<header>Hi, Flamego</header>", render(t, tenant, "header"))
+		assert.Equal(t, "<main>Hello, Joe!</main>", render(t, tenant, "body"))
+		assert.Equal(t, "<header>Flamego</header>", render(t, e, "header"))
+
+		src, _ := tenant.Source("header")
+		assert.Equal(t, `<header>{{greet}}, {{.Title}}</header>`, string(src))
+		src, _ = e.Source("header")
+		assert.Equal(t, `<header>{{.Title}}</header>`, string(src))
+	})
+
+	t.Run("executed", func(t *testing.T) {
+		e, err := NewEngine(Options{Directory: "testdata/fragments"})
+		require.Nil(t, err)
+		render(t, e, "header")
+
+		_, err = e.Clone()
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "clone")
+	})
+
+	t.Run("executed with request functions", func(t *testing.T) {
+		e, err := NewEngine(
+			Options{
+				Directory:     "testdata/fragments",
+				CSRFTokenFunc: func(c flamego.Context) string { return "" },
+			},
+		)
+		require.Nil(t, err)
+		render(t, e, "header")
+
+		tenant, err := e.Clone()
+		require.Nil(t, err)
+		require.Nil(t, tenant.AddTemplate("header", `<header>Tenant</header>`))
+		assert.Equal(t, "<header>Tenant</header>", render(t, tenant, "header"))
+		assert.Equal(t, "<header>Flamego</header>", render(t, e, "header"))
+	})
+
+	t.Run("layouts", func(t *testing.T) {
+		e, err := NewEngine(Options{Directory: "testdata/layouts/blocks"})
+		require.Nil(t, err)
+
+		tenant, err := e.Clone()
+		require.Nil(t, err)
+		require.Nil(t, tenant.AddTemplate("tenant", "{{extends \"base\"}}{{define \"content\"}}tenant content{{end}}"))
+
+		assert.Equal(t, "<html><aside>default sidebar</aside><main>tenant content</main></html>", render(t, tenant, "tenant"))
+		assert.False(t, e.current().has("tenant"))
+	})
+
+	t.Run("include", func(t *testing.T) {
+		e, err := NewEngine(Options{Directory: "testdata/fragments"})
+		require.Nil(t, err)
+		require.Nil(t, e.AddTemplate("widget", "old"))
+		require.Nil(t, e.AddTemplate("page", `{{include "widget" .}}`))
+
+		tenant, err := e.Clone()
+		require.Nil(t, err)
+		require.Nil(t, tenant.AddTemplate("widget", "tenant"))
+
+		// Templates are parsed into clones, which include from themselves.
+		require.Nil(t, e.AddTemplate("widget", "new"))
+		assert.Equal(t, "new", render(t, e, "page"))
+		assert.Equal(t, "tenant", render(t, tenant, "page"))
+	})
+}
+
+func TestEngine_CaseInsensitiveNames(t *testing.T) {
+	t.Run("case-sensitive", func(t *testing.T) {
+		e, err := NewEngine(Options{Directory: "testdata/case"})
+		require.Nil(t, err)
+		assert.True(t, e.HasTemplate("Pages/About"))
+		assert.False(t, e.HasTemplate("pages/about"))
+	})
+
+	e, err := NewEngine(
+		Options{
+			Directory:            "testdata/case",
+			CaseInsensitiveNames: true,
+		},
+	)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"base", "content", "pages/about"}, e.Manifest())
+
+	for _, name := range []string{"pages/about", "Pages/About", "PAGES/ABOUT"} {
+		assert.True(t, e.HasTemplate(name))
+
+		got, err := RenderForTest(
+			Options{
+				Directory:            "testdata/case",
+				CaseInsensitiveNames: true,
+			},
+			name,
+			nil,
+		)
+		require.Nil(t, err)
+		assert.Equal(t, "<html><p>About</p></html>", got)
+	}
+
+	require.Nil(t, e.AddTemplate("Runtime", "<p>Runtime</p>"))
+	assert.True(t, e.HasTemplate("runtime"))
+	require.Nil(t, e.RemoveTemplate("RUNTIME"))
+	assert.False(t, e.HasTemplate("runtime"))
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(e.Handler())
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "Pages/About")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<html><p>About</p></html>", resp.Body.String())
+
+	t.Run("references", func(t *testing.T) {
+		got, err := RenderForTest(
+			Options{
+				Directory:            "testdata/case_references",
+				CaseInsensitiveNames: true,
+			},
+			"Page",
+			Data{"Name": "Flamego"},
+		)
+		require.Nil(t, err)
+		assert.Equal(t, "<b>Flamego</b><b>Flamego</b><b>Flamego</b>", got)
+	})
+}
+
+func TestEngine_Warm(t *testing.T) {
+	pool := &countingBufferPool{}
+	e, err := NewEngine(
+		Options{
+			Directory:  "testdata/fragments",
+			BufferPool: pool,
+		},
+	)
+	require.Nil(t, err)
+
+	e.Warm(3)
+	assert.Equal(t, 3, pool.created)
+	require.Len(t, pool.put, 3)
+	for _, buf := range pool.put {
+		assert.Equal(t, 0, buf.Len())
+		assert.GreaterOrEqual(t, buf.Cap(), warmBufferSize)
+	}
+}
@@ -5,11 +5,17 @@
 package template
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"embed"
+	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -33,21 +39,132 @@ type FileSystem interface {
 }
 
 type file struct {
-	name string
-	data []byte
-	ext  string
+	name    string
+	data    []byte
+	ext     string
+	modTime time.Time // The zero value when unknown
 }
 
 func (f *file) Name() string          { return f.name }
 func (f *file) Data() ([]byte, error) { return f.data, nil }
 func (f *file) Ext() string           { return f.ext }
 
+// NewFile returns a File with given name, data and extension. It is useful for
+// implementing a custom FileSystem, e.g. loading templates from a database.
+func NewFile(name string, data []byte, ext string) File {
+	return &file{
+		name: name,
+		data: data,
+		ext:  ext,
+	}
+}
+
+// diskFile is a File on local disk whose content is read on the first call of
+// Data.
+type diskFile struct {
+	name string
+	path string
+	ext  string
+
+	once sync.Once
+	data []byte
+	err  error
+}
+
+func (f *diskFile) Name() string { return f.name }
+func (f *diskFile) Ext() string  { return f.ext }
+
+func (f *diskFile) Data() ([]byte, error) {
+	f.once.Do(func() {
+		f.data, f.err = os.ReadFile(f.path)
+		if f.err != nil {
+			f.err = errors.Wrap(f.err, "read")
+		}
+	})
+	return f.data, f.err
+}
+
+func (f *diskFile) source() string { return f.path }
+
+func (f *diskFile) modTime() time.Time {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// fileSource returns a human-readable origin of the File, which is the path on
+// disk when known.
+func fileSource(f File) string {
+	if s, ok := f.(interface{ source() string }); ok {
+		return s.source()
+	}
+	return f.Name() + f.Ext()
+}
+
+// fsFile is a File from an fs.FS, e.g. an embed.FS or an archive.
+type fsFile struct {
+	file
+	origin string // The scheme and path, e.g. "embed:templates/home.tmpl"
+}
+
+func (f *fsFile) source() string { return f.origin }
+
+// fileModTime returns the modification time of the File, or the zero value
+// when unknown.
+func fileModTime(f File) time.Time {
+	switch f := f.(type) {
+	case *file:
+		return f.modTime
+	case interface{ modTime() time.Time }:
+		return f.modTime()
+	}
+	return time.Time{}
+}
+
 type fileSystem struct {
 	files []File
 }
 
 func (fs *fileSystem) Files() []File { return fs.files }
 
+// fileLister is a FileSystem that is able to report errors while listing its
+// files.
+type fileLister interface {
+	listFiles() ([]File, error)
+}
+
+// listFiles returns the list of template files of the FileSystem, along with
+// the error reported by the FileSystem if it supports.
+func listFiles(fs FileSystem) ([]File, error) {
+	if l, ok := fs.(fileLister); ok {
+		return l.listFiles()
+	}
+	return fs.Files(), nil
+}
+
+type funcFileSystem struct {
+	list func() ([]File, error)
+}
+
+func (fs *funcFileSystem) Files() []File {
+	files, _ := fs.list()
+	return files
+}
+
+func (fs *funcFileSystem) listFiles() ([]File, error) { return fs.list() }
+
+// FuncFS wraps the given function into a FileSystem, e.g. loading templates
+// from a database. The function is called every time templates are compiled,
+// and its error is returned from the compilation.
+func FuncFS(list func() ([]File, error)) (FileSystem, error) {
+	if list == nil {
+		return nil, errors.New("list function is nil")
+	}
+	return &funcFileSystem{list: list}, nil
+}
+
 // isDir returns true if given path is a directory, and returns false when it's
 // a file or does not exist.
 func isDir(dir string) bool {
@@ -67,49 +184,80 @@ func isFile(path string) bool {
 	return !f.IsDir()
 }
 
-// getExt returns the extension of given name, prefixed with the dot (".").
-func getExt(name string) string {
-	i := strings.Index(name, ".")
-	if i == -1 {
-		return ""
+// matchExt returns the first of allowed extensions that the base name of the
+// given path ends with. Extensions are matched as suffixes, thus compound
+// extensions like ".html.tmpl" are supported, and a leading "*" (e.g.
+// "*.html.tmpl") is ignored. It returns false if none matches or the base name
+// is nothing but the extension.
+func matchExt(name string, allowedExtensions []string) (string, bool) {
+	base := filepath.Base(name)
+	for _, allowed := range allowedExtensions {
+		ext := strings.TrimPrefix(allowed, "*")
+		if ext != "" && len(base) > len(ext) && strings.HasSuffix(base, ext) {
+			return ext, true
+		}
 	}
-	return name[i:]
+	return "", false
 }
 
-// newFileSystem constructs and returns a FileSystem from local disk.
-func newFileSystem(dir string, allowedExtensions []string) (FileSystem, error) {
+// newFileSystem constructs and returns a FileSystem from local disk. The content
+// of files are read lazily unless eager is true.
+func newFileSystem(dir string, allowedExtensions []string, eager bool) (FileSystem, error) {
+	// Clean the directory so that names are derived consistently, e.g. for "./"
+	// and "templates/".
+	dir = filepath.Clean(dir)
+
 	var files []File
-	err := filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if d.IsDir() {
+			return nil
+		}
 
-		ext := getExt(path)
-		for _, allowed := range allowedExtensions {
-			if ext != allowed {
-				continue
-			}
-
-			data, err := os.ReadFile(path)
-			if err != nil {
-				return errors.Wrap(err, "read")
-			}
+		ext, ok := matchExt(path, allowedExtensions)
+		if !ok {
+			return nil
+		}
 
-			relpath, err := filepath.Rel(dir, path)
-			if err != nil {
-				return errors.Wrap(err, "get relative path")
-			}
+		relpath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return errors.Wrap(err, "get relative path")
+		} else if relpath == ".." || strings.HasPrefix(relpath, ".."+string(filepath.Separator)) {
+			return errors.Errorf("%q is not under %q", path, dir)
+		}
 
-			name := filepath.ToSlash(relpath[:len(relpath)-len(ext)])
+		name := filepath.ToSlash(relpath[:len(relpath)-len(ext)])
+		if !eager {
 			files = append(files,
-				&file{
+				&diskFile{
 					name: name,
-					data: data,
+					path: path,
 					ext:  ext,
 				},
 			)
-			break
+			return nil
 		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "read")
+		}
+
+		var modTime time.Time
+		if fi, err := os.Stat(path); err == nil {
+			modTime = fi.ModTime()
+		}
+
+		files = append(files,
+			&file{
+				name:    name,
+				data:    data,
+				ext:     ext,
+				modTime: modTime,
+			},
+		)
 		return nil
 	})
 	if err != nil {
@@ -120,10 +268,86 @@ func newFileSystem(dir string, allowedExtensions []string) (FileSystem, error) {
 	}, nil
 }
 
-// EmbedFS wraps the given embed.FS into a FileSystem.
+// EmbedFS wraps the given embed.FS into a FileSystem. Every embedded file under
+// the directory with allowed extensions is included. Note that files whose
+// names begin with "." or "_" are only embedded by the "all:" prefix of the
+// pattern, e.g. "//go:embed all:templates".
 func EmbedFS(efs embed.FS, dir string, allowedExtensions []string) (FileSystem, error) {
+	return newFSFileSystem(efs, "embed", dir, allowedExtensions)
+}
+
+// ArchiveFS reads the zip archive from r with the given size into a
+// FileSystem. Every file under the directory with allowed extensions is
+// included, and names are derived in the same way as EmbedFS. Use "." as the
+// directory for the root of the archive.
+func ArchiveFS(r io.ReaderAt, size int64, dir string, allowedExtensions []string) (FileSystem, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "open zip")
+	}
+	return newFSFileSystem(zr, "zip", dir, allowedExtensions)
+}
+
+// TarFS is like ArchiveFS but reads the tar archive from r, e.g. wrap r with
+// gzip.NewReader for a ".tar.gz" archive. Only regular files are included.
+func TarFS(r io.Reader, dir string, allowedExtensions []string) (FileSystem, error) {
+	dir = path.Clean(dir)
+
 	var files []File
-	err := fs.WalkDir(efs, dir, func(path string, d fs.DirEntry, err error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "read tar")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		relpath := name
+		if dir != "." {
+			if !strings.HasPrefix(name, dir+"/") {
+				continue
+			}
+			relpath = strings.TrimPrefix(name, dir+"/")
+		}
+
+		ext, ok := matchExt(relpath, allowedExtensions)
+		if !ok {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %q", hdr.Name)
+		}
+
+		files = append(files,
+			&fsFile{
+				file: file{
+					name:    relpath[:len(relpath)-len(ext)],
+					data:    data,
+					ext:     ext,
+					modTime: hdr.ModTime,
+				},
+				origin: "tar:" + name,
+			},
+		)
+	}
+
+	return &fileSystem{
+		files: files,
+	}, nil
+}
+
+// newFSFileSystem constructs and returns a FileSystem from the fs.FS, where
+// the scheme is used to describe the origin of files, e.g. "embed".
+func newFSFileSystem(fsys fs.FS, scheme, dir string, allowedExtensions []string) (FileSystem, error) {
+	var files []File
+	err := fs.WalkDir(fsys, dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -136,27 +360,33 @@ func EmbedFS(efs embed.FS, dir string, allowedExtensions []string) (FileSystem,
 			return errors.Wrap(err, "get relative path")
 		}
 
-		ext := getExt(relpath)
-		for _, allowed := range allowedExtensions {
-			if ext != allowed {
-				continue
-			}
+		ext, ok := matchExt(relpath, allowedExtensions)
+		if !ok {
+			return nil
+		}
 
-			data, err := efs.ReadFile(path)
-			if err != nil {
-				return errors.Wrap(err, "read")
-			}
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return errors.Wrap(err, "read")
+		}
 
-			name := filepath.ToSlash(relpath[:len(relpath)-len(ext)])
-			files = append(files,
-				&file{
-					name: name,
-					data: data,
-					ext:  ext,
-				},
-			)
+		var modTime time.Time
+		if fi, err := d.Info(); err == nil {
+			modTime = fi.ModTime()
 		}
 
+		name := filepath.ToSlash(relpath[:len(relpath)-len(ext)])
+		files = append(files,
+			&fsFile{
+				file: file{
+					name:    name,
+					data:    data,
+					ext:     ext,
+					modTime: modTime,
+				},
+				origin: scheme + ":" + path,
+			},
+		)
 		return nil
 	})
 	if err != nil {
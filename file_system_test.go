@@ -5,11 +5,16 @@
 package template
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"embed"
+	"errors"
 	gotemplate "html/template"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -23,6 +28,12 @@ import (
 //go:embed testdata/basic/*
 var basicTemplates embed.FS
 
+//go:embed all:testdata/embed
+var allTemplates embed.FS
+
+//go:embed testdata/embed
+var visibleTemplates embed.FS
+
 func TestEmbedFS(t *testing.T) {
 	fs, err := EmbedFS(basicTemplates, "testdata/basic", []string{".tmpl"})
 	require.Nil(t, err)
@@ -62,3 +73,328 @@ func TestEmbedFS(t *testing.T) {
 	}
 	require.Equal(t, want, resp.Body.String())
 }
+
+type memoryFileSystem []File
+
+func (fs memoryFileSystem) Files() []File { return fs }
+
+func TestNewFile(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			FileSystem: memoryFileSystem{
+				NewFile("home", []byte(`Hello, {{.Name}}!`), ".tmpl"),
+			},
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Name"] = "Flamego"
+		t.HTML(http.StatusOK, "home")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "Hello, Flamego!", resp.Body.String())
+}
+
+func TestFuncFS(t *testing.T) {
+	t.Run("nil function", func(t *testing.T) {
+		_, err := FuncFS(nil)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("loader error", func(t *testing.T) {
+		fs, err := FuncFS(func() ([]File, error) {
+			return nil, errors.New("connection refused")
+		})
+		require.Nil(t, err)
+
+		_, err = NewEngine(Options{FileSystem: fs})
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "connection refused")
+	})
+
+	fs, err := FuncFS(func() ([]File, error) {
+		return []File{
+			NewFile("home", []byte(`Hello, {{.Name}}!`), ".tmpl"),
+		}, nil
+	})
+	require.Nil(t, err)
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(Options{FileSystem: fs}))
+	f.Get("/", func(t Template, data Data) {
+		data["Name"] = "Flamego"
+		t.HTML(http.StatusOK, "home")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "Hello, Flamego!", resp.Body.String())
+}
+
+func TestNewFileSystem(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "home.tmpl")
+	require.Nil(t, os.WriteFile(path, []byte("before"), 0644))
+
+	lazy, err := newFileSystem(dir, []string{".tmpl"}, false)
+	require.Nil(t, err)
+	eager, err := newFileSystem(dir, []string{".tmpl"}, true)
+	require.Nil(t, err)
+
+	require.Nil(t, os.WriteFile(path, []byte("after"), 0644))
+
+	require.Len(t, lazy.Files(), 1)
+	assert.Equal(t, "home", lazy.Files()[0].Name())
+	assert.Equal(t, ".tmpl", lazy.Files()[0].Ext())
+	data, err := lazy.Files()[0].Data()
+	require.Nil(t, err)
+	assert.Equal(t, "after", string(data))
+
+	require.Len(t, eager.Files(), 1)
+	data, err = eager.Files()[0].Data()
+	require.Nil(t, err)
+	assert.Equal(t, "before", string(data))
+}
+
+// archiveEntries are the files of archives used in tests.
+var archiveEntries = []struct {
+	name string
+	body string
+}{
+	{name: "templates/home.tmpl", body: "<p>Home</p>"},
+	{name: "templates/admin/dashboard.html.tmpl", body: "<p>Dashboard</p>"},
+	{name: "templates/README.md", body: "# Templates"},
+	{name: "other/home.tmpl", body: "<p>Other</p>"},
+}
+
+// archiveFiles returns the name, data and source of each file in the
+// FileSystem.
+func archiveFiles(t *testing.T, fs FileSystem) [][3]string {
+	var got [][3]string
+	for _, f := range fs.Files() {
+		data, err := f.Data()
+		require.Nil(t, err)
+		got = append(got, [3]string{f.Name() + f.Ext(), string(data), fileSource(f)})
+	}
+	return got
+}
+
+func TestArchiveFS(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range archiveEntries {
+		w, err := zw.Create(entry.name)
+		require.Nil(t, err)
+		_, err = w.Write([]byte(entry.body))
+		require.Nil(t, err)
+	}
+	require.Nil(t, zw.Close())
+
+	r := bytes.NewReader(buf.Bytes())
+	fs, err := ArchiveFS(r, r.Size(), "templates", []string{".tmpl"})
+	require.Nil(t, err)
+
+	want := [][3]string{
+		{"admin/dashboard.html.tmpl", "<p>Dashboard</p>", "zip:templates/admin/dashboard.html.tmpl"},
+		{"home.tmpl", "<p>Home</p>", "zip:templates/home.tmpl"},
+	}
+	assert.Equal(t, want, archiveFiles(t, fs))
+
+	t.Run("not a zip", func(t *testing.T) {
+		r := strings.NewReader("not a zip")
+		_, err := ArchiveFS(r, r.Size(), ".", []string{".tmpl"})
+		require.NotNil(t, err)
+	})
+}
+
+func TestTarFS(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.Nil(t, tw.WriteHeader(&tar.Header{Name: "templates/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, entry := range archiveEntries {
+		err := tw.WriteHeader(
+			&tar.Header{
+				Name:     "./" + entry.name,
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     int64(len(entry.body)),
+			},
+		)
+		require.Nil(t, err)
+		_, err = tw.Write([]byte(entry.body))
+		require.Nil(t, err)
+	}
+	require.Nil(t, tw.Close())
+
+	tests := []struct {
+		name string
+		dir  string
+		want [][3]string
+	}{
+		{
+			name: "directory",
+			dir:  "templates",
+			want: [][3]string{
+				{"home.tmpl", "<p>Home</p>", "tar:templates/home.tmpl"},
+				{"admin/dashboard.html.tmpl", "<p>Dashboard</p>", "tar:templates/admin/dashboard.html.tmpl"},
+			},
+		},
+		{
+			name: "root",
+			dir:  ".",
+			want: [][3]string{
+				{"templates/home.tmpl", "<p>Home</p>", "tar:templates/home.tmpl"},
+				{"templates/admin/dashboard.html.tmpl", "<p>Dashboard</p>", "tar:templates/admin/dashboard.html.tmpl"},
+				{"other/home.tmpl", "<p>Other</p>", "tar:other/home.tmpl"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, err := TarFS(bytes.NewReader(buf.Bytes()), test.dir, []string{".tmpl"})
+			require.Nil(t, err)
+			assert.Equal(t, test.want, archiveFiles(t, fs))
+		})
+	}
+}
+
+func TestMatchExt(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		allowed []string
+		wantExt string
+		wantOK  bool
+	}{
+		{
+			name:    "simple",
+			path:    "templates/home.tmpl",
+			allowed: []string{".tmpl", ".html"},
+			wantExt: ".tmpl",
+			wantOK:  true,
+		},
+		{
+			name:    "compound file name",
+			path:    "templates/page.html.tmpl",
+			allowed: []string{".tmpl"},
+			wantExt: ".tmpl",
+			wantOK:  true,
+		},
+		{
+			name:    "compound extension",
+			path:    "templates/page.html.tmpl",
+			allowed: []string{".html.tmpl", ".tmpl"},
+			wantExt: ".html.tmpl",
+			wantOK:  true,
+		},
+		{
+			name:    "glob",
+			path:    "templates/page.html.tmpl",
+			allowed: []string{"*.html.tmpl"},
+			wantExt: ".html.tmpl",
+			wantOK:  true,
+		},
+		{
+			name:    "dotted directory",
+			path:    "./v1.0/home.tmpl",
+			allowed: []string{".tmpl"},
+			wantExt: ".tmpl",
+			wantOK:  true,
+		},
+		{
+			name:    "no match",
+			path:    "templates/home.txt",
+			allowed: []string{".tmpl", ".html"},
+		},
+		{
+			name:    "extension only",
+			path:    "templates/.tmpl",
+			allowed: []string{".tmpl"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ext, ok := matchExt(test.path, test.allowed)
+			assert.Equal(t, test.wantExt, ext)
+			assert.Equal(t, test.wantOK, ok)
+		})
+	}
+}
+
+func TestNewFileSystem_CompoundExtensions(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"page.html.tmpl", "feed.xml.tmpl", "home.tmpl"} {
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+
+	fs, err := newFileSystem(dir, []string{"*.html.tmpl", ".tmpl"}, false)
+	require.Nil(t, err)
+
+	got := make(map[string]string)
+	for _, f := range fs.Files() {
+		got[f.Name()] = f.Ext()
+	}
+	want := map[string]string{
+		"page":     ".html.tmpl",
+		"feed.xml": ".tmpl",
+		"home":     ".tmpl",
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestEmbedFS_HiddenFiles(t *testing.T) {
+	names := func(efs embed.FS) []string {
+		fs, err := EmbedFS(efs, "testdata/embed", []string{".tmpl"})
+		require.Nil(t, err)
+
+		var names []string
+		for _, f := range fs.Files() {
+			names = append(names, f.Name())
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{".well-known/security", "_partial", "home"}, names(allTemplates))
+	assert.Equal(t, []string{"home"}, names(visibleTemplates))
+}
+
+func TestNewFileSystem_Directory(t *testing.T) {
+	abs, err := filepath.Abs("testdata/fragments")
+	require.Nil(t, err)
+
+	names := func(dir string) []string {
+		fs, err := newFileSystem(dir, []string{".tmpl"}, false)
+		require.Nil(t, err)
+
+		var names []string
+		for _, f := range fs.Files() {
+			names = append(names, f.Name())
+		}
+		return names
+	}
+
+	want := []string{"body", "broken", "header"}
+	assert.Equal(t, want, names("testdata/fragments"))
+	assert.Equal(t, want, names("./testdata/fragments/"))
+	assert.Equal(t, want, names(abs))
+
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Nil(t, os.Chdir(abs))
+	defer func() { _ = os.Chdir(wd) }()
+
+	assert.Equal(t, want, names("."))
+	assert.Equal(t, want, names("./"))
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"sync"
+	"time"
+)
+
+// FragmentCache is a cache for rendered fragments, see
+// Template.CachedFragment.
+type FragmentCache interface {
+	// Get returns the cached content of the key, or false if it does not exist or
+	// has expired.
+	Get(key string) ([]byte, bool)
+	// Set caches the content under the key for the given duration.
+	Set(key string, content []byte, ttl time.Duration)
+}
+
+var _ FragmentCache = (*memoryFragmentCache)(nil)
+
+type memoryFragmentCache struct {
+	lock    sync.Mutex
+	entries map[string]memoryFragment
+}
+
+type memoryFragment struct {
+	content   []byte
+	expiresAt time.Time
+}
+
+// NewMemoryFragmentCache returns a FragmentCache that stores fragments in
+// memory. Expired fragments are only evicted on access, thus it is meant for
+// a bounded set of keys.
+func NewMemoryFragmentCache() FragmentCache {
+	return &memoryFragmentCache{
+		entries: make(map[string]memoryFragment),
+	}
+}
+
+func (c *memoryFragmentCache) Get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	} else if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.content, true
+}
+
+func (c *memoryFragmentCache) Set(key string, content []byte, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[key] = memoryFragment{
+		content:   content,
+		expiresAt: time.Now().Add(ttl),
+	}
+}
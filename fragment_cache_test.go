@@ -0,0 +1,64 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/flamego/flamego"
+)
+
+func TestMemoryFragmentCache(t *testing.T) {
+	c := NewMemoryFragmentCache()
+
+	_, ok := c.Get("widget")
+	assert.False(t, ok)
+
+	c.Set("widget", []byte("<p>Widget</p>"), time.Minute)
+	got, ok := c.Get("widget")
+	assert.True(t, ok)
+	assert.Equal(t, "<p>Widget</p>", string(got))
+
+	c.Set("expired", []byte("<p>Expired</p>"), -time.Second)
+	_, ok = c.Get("expired")
+	assert.False(t, ok)
+}
+
+func TestTemplate_CachedFragment(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+		},
+	))
+	f.Get("/{name}", func(c flamego.Context, t Template, data Data) {
+		data["Title"] = c.Param("name")
+		header, err := t.CachedFragment("header", "v1", time.Minute)
+		if err != nil {
+			c.ResponseWriter().WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = c.ResponseWriter().Write([]byte(header))
+	})
+
+	for _, name := range []string{"first", "second"} {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/"+name, nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		// The fragment rendered by the first request is served from cache.
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "<header>first</header>", resp.Body.String())
+	}
+}
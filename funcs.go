@@ -0,0 +1,589 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	gotemplate "html/template"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	texttemplate "text/template"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	"github.com/flamego/flamego"
+)
+
+// funcMaps returns the list of template.FuncMap to be applied for parsing
+// templates. Built-in functions come first, thus can be overridden by
+// Options.FuncMaps.
+func funcMaps(opts Options) []gotemplate.FuncMap {
+	builtin := gotemplate.FuncMap{}
+	if opts.WithDefaultFuncs {
+		for name, fn := range defaultFuncs() {
+			builtin[name] = fn
+		}
+	}
+	if opts.AssetManifest != nil {
+		builtin["asset"] = assetFunc(opts.AssetManifest)
+	}
+	if opts.Sanitizer != nil {
+		builtin["sanitize"] = sanitizeFunc(opts.Sanitizer)
+	}
+	for name, fn := range requestFuncs(opts, nil, nil) {
+		builtin[name] = fn
+	}
+	// The placeholder for parsing templates, see bindRender.
+	builtin["render"] = func(string, interface{}) (gotemplate.HTML, error) {
+		return "", errors.New("render: not bound")
+	}
+
+	if len(builtin) == 0 {
+		return opts.FuncMaps
+	}
+	return append([]gotemplate.FuncMap{builtin}, opts.FuncMaps...)
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// MustFunc returns the function as-is if it is valid to be used in a
+// template.FuncMap, which returns either a single value, or a value and an
+// error. Otherwise, it panics with a descriptive message. Returning a non-nil
+// error from a function stops the execution of the template, and the error is
+// responded with status 500 by Template.HTML, which includes names of both the
+// template and the function, e.g.:
+//
+//	FuncMaps: []template.FuncMap{
+//		{
+//			"user": template.MustFunc(func(id int64) (*User, error) {
+//				return db.GetUser(id)
+//			}),
+//		},
+//	}
+func MustFunc(fn interface{}) interface{} {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		panic(fmt.Sprintf("template: MustFunc: %T is not a function", fn))
+	}
+
+	typ := v.Type()
+	switch {
+	case typ.NumOut() == 1:
+	case typ.NumOut() == 2 && typ.Out(1) == errorType:
+	default:
+		panic(fmt.Sprintf("template: MustFunc: %s must return a single value, or a value and an error", typ))
+	}
+	return fn
+}
+
+// validateFuncs returns an error if any of the functions is not valid to be used
+// in a template.FuncMap, which would otherwise panic.
+func validateFuncs(funcs gotemplate.FuncMap) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("invalid functions: %v", r)
+		}
+	}()
+	gotemplate.New("").Funcs(funcs)
+	return nil
+}
+
+// assetFunc returns a template function that maps the logical path of an asset
+// to its fingerprinted URL using the manifest. The path is returned as-is when
+// it is not in the manifest.
+func assetFunc(manifest map[string]string) func(path string) string {
+	return func(path string) string {
+		if url, ok := manifest[path]; ok {
+			return url
+		}
+		return path
+	}
+}
+
+// sanitizeFunc returns a template function that sanitizes the string using the
+// sanitizer and marks the result as safe HTML.
+func sanitizeFunc(sanitizer func(string) string) func(s string) gotemplate.HTML {
+	return func(s string) gotemplate.HTML {
+		return gotemplate.HTML(sanitizer(s))
+	}
+}
+
+// defaultFuncs returns the set of functions that are registered when
+// Options.WithDefaultFuncs is enabled.
+func defaultFuncs() gotemplate.FuncMap {
+	return gotemplate.FuncMap{
+		"upper":    strings.ToUpper,
+		"lower":    strings.ToLower,
+		"title":    title,
+		"join":     join,
+		"default":  defaultValue,
+		"dict":     dict,
+		"safeHTML": safeHTML,
+		"safe":     safeHTML,
+		"jsonSafe": jsonSafe,
+
+		"pages":     pages,
+		"pageRange": pageRange,
+		"hasPrev":   hasPrev,
+		"hasNext":   hasNext,
+	}
+}
+
+// title returns a copy of the string with the first letter of each word mapped
+// to its title case.
+func title(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	prev := ' '
+	for _, r := range s {
+		if unicode.IsSpace(prev) {
+			b.WriteRune(unicode.ToTitle(r))
+		} else {
+			b.WriteRune(r)
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+// join concatenates elements of the slice or array to create a single string,
+// using the separator between elements.
+func join(sep string, v interface{}) (string, error) {
+	if ss, ok := v.([]string); ok {
+		return strings.Join(ss, sep), nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: unsupported type %T", v)
+	}
+
+	elems := make([]string, rv.Len())
+	for i := range elems {
+		elems[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return strings.Join(elems, sep), nil
+}
+
+// defaultValue returns the given value if it is not empty, otherwise returns
+// the default value, e.g. `{{.Name | default "Anonymous"}}`.
+func defaultValue(def, given interface{}) interface{} {
+	if given == nil {
+		return def
+	}
+
+	rv := reflect.ValueOf(given)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Chan, reflect.Map, reflect.Slice, reflect.String:
+		if rv.Len() == 0 {
+			return def
+		}
+	case reflect.Interface, reflect.Ptr:
+		if rv.IsNil() {
+			return def
+		}
+	default:
+		if rv.IsZero() {
+			return def
+		}
+	}
+	return given
+}
+
+// dict returns a map built from the list of key-value pairs, which is useful for
+// passing multiple values to a template, e.g.
+// `{{template "card" (dict "Title" .Title "Body" .Body)}}`.
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict: odd number of arguments %d", len(pairs))
+	}
+
+	m := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: key at position %d is %T, not a string", i, pairs[i])
+		}
+		m[key] = pairs[i+1]
+	}
+	return m, nil
+}
+
+// safeHTML marks the string as known safe HTML, thus it is not escaped. It must
+// never be used with untrusted content.
+func safeHTML(s string) gotemplate.HTML {
+	return gotemplate.HTML(s)
+}
+
+// jsonSafe returns the JSON encoding of the value to be embedded in a <script>
+// element, e.g. `<script>const user = {{jsonSafe .User}};</script>`. The "<",
+// ">" and "&" characters (as well as U+2028 and U+2029) are escaped to unicode
+// sequences so that strings like "</script>" cannot break out of the element.
+func jsonSafe(v interface{}) (gotemplate.JS, error) {
+	// json.Marshal escapes HTML characters by default.
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrap(err, "jsonSafe")
+	}
+	return gotemplate.JS(b), nil
+}
+
+// pages returns the number of pages for the total count of items with perPage
+// items on each page. It returns 0 when there is no item or perPage is not
+// positive.
+func pages(perPage, total int) int {
+	if perPage <= 0 || total <= 0 {
+		return 0
+	}
+	return (total + perPage - 1) / perPage
+}
+
+// pageRange returns at most size page numbers around the current page, which is
+// clamped to the valid range, e.g. `{{range pageRange .Page 10 .Total 5}}`
+// ranges over [3 4 5 6 7] for the page 5 of 10 pages.
+func pageRange(page, perPage, total, size int) []int {
+	n := pages(perPage, total)
+	if n == 0 || size <= 0 {
+		return []int{}
+	}
+
+	if page < 1 {
+		page = 1
+	} else if page > n {
+		page = n
+	}
+
+	start := page - (size-1)/2
+	if start < 1 {
+		start = 1
+	}
+	end := start + size - 1
+	if end > n {
+		end = n
+		start = end - size + 1
+		if start < 1 {
+			start = 1
+		}
+	}
+
+	nums := make([]int, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		nums = append(nums, i)
+	}
+	return nums
+}
+
+// hasPrev returns true if there is a page before the current page.
+func hasPrev(page, perPage, total int) bool {
+	return page > 1 && pages(perPage, total) > 0
+}
+
+// hasNext returns true if there is a page after the current page.
+func hasNext(page, perPage, total int) bool {
+	return page < pages(perPage, total)
+}
+
+// hasRequestFuncs returns true if any function needs to be bound per request.
+// Because html/template does not allow changing functions of a set once it has
+// been executed, requests acquire clones of the set with such functions bound
+// from a pool, see templateSet.acquire.
+func hasRequestFuncs(opts Options) bool {
+	return opts.CSRFTokenFunc != nil ||
+		opts.LocalizerFunc != nil ||
+		opts.WithContextFunc ||
+		opts.WithURLFuncs ||
+		opts.WithStatusFunc ||
+		opts.WithScopeFunc
+}
+
+// renderState is the state of the request that a pooled clone of the set is
+// acquired for, which is read by functions bound to the clone. It is set when
+// the clone is acquired and cleared when the clone is released.
+type renderState struct {
+	c flamego.Context
+	t *template
+	// depth is the depth of nested calls of the "include" and "render" functions.
+	depth int
+	// localize is the result of Options.LocalizerFunc for the request, which is
+	// only resolved on first use.
+	localize func(key string, args ...interface{}) string
+}
+
+// requestFuncs returns functions that read the request and the Template t of
+// the request from the state, where trustedProxies is the parsed list of
+// Options.TrustedProxies. The functions behave as placeholders for parsing
+// templates when there is no request, e.g. the state is nil. Functions defined
+// by Options.FuncMaps are skipped.
+func requestFuncs(opts Options, trustedProxies []*net.IPNet, state *renderState) gotemplate.FuncMap {
+	if state == nil {
+		state = &renderState{}
+	}
+
+	funcs := gotemplate.FuncMap{}
+	if opts.CSRFTokenFunc != nil {
+		token := func() string {
+			if state.c == nil {
+				return ""
+			}
+			return opts.CSRFTokenFunc(state.c)
+		}
+		funcs["csrfToken"] = token
+		funcs["csrfField"] = func() gotemplate.HTML {
+			return gotemplate.HTML(`<input type="hidden" name="` + gotemplate.HTMLEscapeString(opts.CSRFFieldName) + `" value="` + gotemplate.HTMLEscapeString(token()) + `">`)
+		}
+	}
+	if opts.LocalizerFunc != nil {
+		funcs["T"] = func(key string, args ...interface{}) string {
+			if state.c == nil {
+				return key
+			}
+			if state.localize == nil {
+				state.localize = opts.LocalizerFunc(state.c)
+			}
+			return state.localize(key, args...)
+		}
+	}
+	if opts.WithContextFunc {
+		funcs["context"] = func() context.Context {
+			if state.t == nil {
+				return context.Background()
+			}
+			return state.t.context()
+		}
+	}
+	if opts.WithStatusFunc {
+		funcs["status"] = func(status int) (string, error) {
+			if status < 100 || status > 999 {
+				return "", errors.Errorf("invalid status code %d", status)
+			}
+			if state.t != nil {
+				state.t.templateStatus = status
+			}
+			return "", nil
+		}
+	}
+	if opts.WithScopeFunc {
+		funcs["scope"] = func(name string) Data {
+			if state.t == nil {
+				return Data{}
+			}
+			return state.t.scopeData(name)
+		}
+	}
+	if opts.WithURLFuncs {
+		base := func() string {
+			if state.c == nil {
+				return ""
+			}
+			return baseURL(state.c.Request().Request, trustedProxies)
+		}
+		funcs["baseURL"] = base
+		funcs["absURL"] = func(path string) string {
+			if strings.Contains(path, "://") {
+				return path
+			}
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			return base() + path
+		}
+	}
+
+	for name := range funcs {
+		if userDefined(opts, name) {
+			delete(funcs, name)
+		}
+	}
+	return funcs
+}
+
+// parseTrustedProxies parses the list of IP addresses and CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP address %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse CIDR %q", proxy)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// baseURL returns the scheme and host of the request, e.g.
+// "https://example.com". The "X-Forwarded-Proto" and "X-Forwarded-Host"
+// headers are only honored when the request comes from one of the trusted
+// proxies.
+func baseURL(r *http.Request, trustedProxies []*net.IPNet) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if isTrustedProxy(r.RemoteAddr, trustedProxies) {
+		// Only the first value is relevant when there are multiple proxies.
+		if proto := firstHeaderValue(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwarded := firstHeaderValue(r.Header.Get("X-Forwarded-Host")); forwarded != "" {
+			host = forwarded
+		}
+	}
+	return scheme + "://" + host
+}
+
+// isTrustedProxy returns true if the IP address of the remote address is within
+// any of the trusted proxies.
+func isTrustedProxy(remoteAddr string, trustedProxies []*net.IPNet) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstHeaderValue returns the first of comma-separated values of a header.
+func firstHeaderValue(v string) string {
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(v, ",", 2)[0]))
+}
+
+// userDefined returns true if the named function is defined by
+// Options.FuncMaps.
+func userDefined(opts Options, name string) bool {
+	for _, funcMap := range opts.FuncMaps {
+		if _, ok := funcMap[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bindInclude binds the "include" function to the html/template set with the
+// state of the execution unless it is defined by Options.FuncMaps. The function
+// fails to be called when the state is nil, i.e. for parsing templates.
+func bindInclude(opts Options, tpl *gotemplate.Template, state *renderState) {
+	if userDefined(opts, "include") {
+		return
+	}
+	tpl.Funcs(gotemplate.FuncMap{
+		"include": func(name string, data interface{}) (gotemplate.HTML, error) {
+			s, err := nested(state, "include", tpl.ExecuteTemplate, maxRenderDepth(opts), normalizeName(opts, name), data)
+			return gotemplate.HTML(s), err
+		},
+	})
+}
+
+// bindTextInclude is like bindInclude but for the text/template set.
+func bindTextInclude(opts Options, tpl *texttemplate.Template, state *renderState) {
+	if userDefined(opts, "include") {
+		return
+	}
+	tpl.Funcs(texttemplate.FuncMap{
+		"include": func(name string, data interface{}) (string, error) {
+			return nested(state, "include", tpl.ExecuteTemplate, maxRenderDepth(opts), normalizeName(opts, name), data)
+		},
+	})
+}
+
+// defaultMaxRenderDepth is the default of Options.MaxRenderDepth.
+const defaultMaxRenderDepth = 100
+
+// maxRenderDepth returns the maximum depth of nested calls of the "include" and
+// "render" functions, which guards against infinite recursion.
+func maxRenderDepth(opts Options) int {
+	if opts.MaxRenderDepth > 0 {
+		return opts.MaxRenderDepth
+	}
+	return defaultMaxRenderDepth
+}
+
+// nested executes the named template with the data and returns the output,
+// which is the implementation of the "include" and "render" functions named by
+// the label, e.g. `{{include "widgets/user" .}}`. Nested calls of both
+// functions are counted by the state of the execution.
+func nested(state *renderState, label string, execute func(w io.Writer, name string, data interface{}) error, maxDepth int, name string, data interface{}) (string, error) {
+	if state == nil {
+		return "", errors.Errorf("%s: not bound", label)
+	} else if state.depth >= maxDepth {
+		return "", fmt.Errorf("%s %q: exceeded maximum depth %d", label, name, maxDepth)
+	}
+	state.depth++
+	defer func() { state.depth-- }()
+
+	var buf bytes.Buffer
+	err := execute(&buf, name, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// bindRender binds the "render" function to the set unless it is defined by
+// Options.FuncMaps. Unlike the "include" function, the template is rendered
+// with its layout chain applied when it extends other templates, e.g.
+// `{{render "widgets/user" .}}`.
+func bindRender(s *templateSet) {
+	funcs := s.renderFuncs()
+	if funcs == nil {
+		return
+	}
+
+	s.html.Funcs(funcs)
+	s.layoutsLock.Lock()
+	for _, l := range s.layouts {
+		l.tpl.Funcs(funcs)
+	}
+	s.layoutsLock.Unlock()
+}
+
+// renderFuncs returns the "render" function bound to the set and its state, or
+// nil if it is defined by Options.FuncMaps or the set has no state, in which
+// case the placeholder is kept.
+func (s *templateSet) renderFuncs() gotemplate.FuncMap {
+	if userDefined(s.opts, "render") || s.state == nil {
+		return nil
+	}
+	return gotemplate.FuncMap{
+		"render": func(name string, data interface{}) (gotemplate.HTML, error) {
+			out, err := nested(s.state, "render", s.execute, maxRenderDepth(s.opts), normalizeName(s.opts, name), data)
+			return gotemplate.HTML(out), err
+		},
+	}
+}
@@ -0,0 +1,598 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"errors"
+	gotemplate "html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/flamego/flamego"
+)
+
+func TestAssetFunc(t *testing.T) {
+	tpl, err := newTemplate(
+		Options{
+			Directory:  "testdata/assets",
+			Extensions: []string{".tmpl"},
+			AssetManifest: map[string]string{
+				"css/app.css": "/css/app.abc123.css",
+			},
+		},
+		log.New(&bytes.Buffer{}),
+	)
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	err = tpl.ExecuteTemplate(&buf, "home", nil)
+	require.Nil(t, err)
+	assert.Equal(t, `<link rel="stylesheet" href="/css/app.abc123.css"><script src="js/app.js"></script>`, buf.String())
+}
+
+func TestSanitizeFunc(t *testing.T) {
+	got, err := RenderForTest(
+		Options{
+			Directory: "testdata/sanitize",
+			Sanitizer: func(s string) string {
+				return strings.ReplaceAll(s, "<script>", "")
+			},
+		},
+		"comment",
+		Data{"Comment": "<b>Hi</b><script>"},
+	)
+	require.Nil(t, err)
+	assert.Equal(t, "<div><b>Hi</b></div><p>&lt;b&gt;Hi&lt;/b&gt;&lt;script&gt;</p>", got)
+
+	// The function is not registered without a sanitizer.
+	_, err = NewEngine(Options{Directory: "testdata/sanitize"})
+	assert.NotNil(t, err)
+}
+
+func TestDefaultFuncs(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		data     interface{}
+		want     string
+	}{
+		{
+			name:     "upper",
+			template: `{{upper "flamego"}}`,
+			want:     "FLAMEGO",
+		},
+		{
+			name:     "lower",
+			template: `{{lower "FLAMEGO"}}`,
+			want:     "flamego",
+		},
+		{
+			name:     "title",
+			template: `{{title "hello, flamego world"}}`,
+			want:     "Hello, Flamego World",
+		},
+		{
+			name:     "join strings",
+			template: `{{join ", " .}}`,
+			data:     []string{"a", "b", "c"},
+			want:     "a, b, c",
+		},
+		{
+			name:     "join integers",
+			template: `{{join "-" .}}`,
+			data:     []int{1, 2, 3},
+			want:     "1-2-3",
+		},
+		{
+			name:     "default with empty value",
+			template: `{{.Name | default "Anonymous"}}`,
+			data:     map[string]string{},
+			want:     "Anonymous",
+		},
+		{
+			name:     "default with value",
+			template: `{{.Name | default "Anonymous"}}`,
+			data:     map[string]string{"Name": "Flamego"},
+			want:     "Flamego",
+		},
+		{
+			name:     "default with zero number",
+			template: `{{default 10 .}}`,
+			data:     0,
+			want:     "10",
+		},
+		{
+			name:     "dict",
+			template: `{{define "card"}}{{.Title}}: {{.Body}}{{end}}{{template "card" (dict "Title" "Hi" "Body" .)}}`,
+			data:     "Flamego",
+			want:     "Hi: Flamego",
+		},
+		{
+			name:     "safeHTML",
+			template: `{{safeHTML "<b>bold</b>"}} {{"<b>bold</b>"}}`,
+			want:     "<b>bold</b> &lt;b&gt;bold&lt;/b&gt;",
+		},
+		{
+			name:     "safe",
+			template: `{{. | safe}}`,
+			data:     "<b>bold</b>",
+			want:     "<b>bold</b>",
+		},
+		{
+			name:     "jsonSafe",
+			template: `<script>const user = {{jsonSafe .}};</script>`,
+			data:     map[string]string{"Name": "Joe & Co"},
+			want:     `<script>const user = {"Name":"Joe \u0026 Co"};</script>`,
+		},
+		{
+			name:     "jsonSafe script breakout",
+			template: `<script>const s = {{jsonSafe .}};</script>`,
+			data:     "</script><script>alert(1)</script>",
+			want:     `<script>const s = "\u003c/script\u003e\u003cscript\u003ealert(1)\u003c/script\u003e";</script>`,
+		},
+		{
+			name:     "pagination",
+			template: `{{if hasPrev .Page 10 .Total}}prev {{end}}{{range pageRange .Page 10 .Total 3}}{{.}} {{end}}{{if hasNext .Page 10 .Total}}next{{end}} of {{pages 10 .Total}}`,
+			data:     map[string]int{"Page": 2, "Total": 45},
+			want:     "prev 1 2 3 next of 5",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tpl, err := gotemplate.New("test").Funcs(defaultFuncs()).Parse(test.template)
+			require.Nil(t, err)
+
+			var buf bytes.Buffer
+			err = tpl.Execute(&buf, test.data)
+			require.Nil(t, err)
+			assert.Equal(t, test.want, buf.String())
+		})
+	}
+}
+
+func TestFuncMaps(t *testing.T) {
+	fms := funcMaps(
+		Options{
+			WithDefaultFuncs: true,
+			FuncMaps: []gotemplate.FuncMap{
+				{"upper": func(s string) string { return "overridden" }},
+			},
+		},
+	)
+	tpl, err := gotemplate.New("test").Funcs(fms[0]).Funcs(fms[1]).Parse(`{{upper "flamego"}} {{lower "FLAMEGO"}}`)
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "overridden flamego", buf.String())
+}
+
+func TestDict(t *testing.T) {
+	got, err := dict("a", 1, "b", "2")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"a": 1, "b": "2"}, got)
+
+	_, err = dict("a", 1, "b")
+	assert.EqualError(t, err, "dict: odd number of arguments 3")
+
+	_, err = dict("a", 1, 2, 3)
+	assert.EqualError(t, err, "dict: key at position 2 is int, not a string")
+}
+
+func TestInclude(t *testing.T) {
+	opts := Options{
+		Directory:  "testdata/include",
+		Extensions: []string{".tmpl"},
+	}
+	got, err := RenderForTest(opts, "home", Data{"Name": "<Flamego>"})
+	require.Nil(t, err)
+	assert.Equal(t, "<p><span>&lt;Flamego&gt;</span></p>", got)
+
+	_, err = RenderForTest(opts, "loop", nil)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "exceeded maximum depth 100")
+
+	// Templates are only executed by clones with the state of the execution.
+	tpl, err := newTemplate(opts, log.New(&bytes.Buffer{}))
+	require.Nil(t, err)
+	err = tpl.ExecuteTemplate(io.Discard, "home", nil)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "include: not bound")
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{
+			name: "shared",
+			opts: Options{Directory: "testdata/render"},
+		},
+		{
+			name: "request functions",
+			opts: Options{
+				Directory:       "testdata/render",
+				WithContextFunc: true,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := RenderForTest(test.opts, "home", Data{"Name": "<Flamego>"})
+			require.Nil(t, err)
+			assert.Equal(t, `<main><div class="widget"><b>&lt;Flamego&gt;</b></div></main>`, got)
+
+			_, err = RenderForTest(test.opts, "loop", nil)
+			require.NotNil(t, err)
+			assert.Contains(t, err.Error(), `render "loop": exceeded maximum depth 100`)
+		})
+	}
+}
+
+func TestMaxRenderDepth(t *testing.T) {
+	tests := []struct {
+		name     string
+		dir      string
+		maxDepth int
+		want     string
+	}{
+		{
+			name: "include with default",
+			dir:  "testdata/include",
+			want: `include "loop": exceeded maximum depth 100`,
+		},
+		{
+			name:     "include",
+			dir:      "testdata/include",
+			maxDepth: 5,
+			want:     `include "loop": exceeded maximum depth 5`,
+		},
+		{
+			name:     "render",
+			dir:      "testdata/render",
+			maxDepth: 5,
+			want:     `render "loop": exceeded maximum depth 5`,
+		},
+		{
+			name:     "include and render",
+			dir:      "testdata/nesting",
+			maxDepth: 5,
+			want:     `render "loop": exceeded maximum depth 5`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					Directory:      test.dir,
+					MaxRenderDepth: test.maxDepth,
+				},
+			))
+			f.Get("/", func(t Template) {
+				t.HTML(http.StatusOK, "loop")
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusInternalServerError, resp.Code)
+			assert.Contains(t, resp.Body.String(), test.want)
+		})
+	}
+}
+
+func TestMustFunc(t *testing.T) {
+	t.Run("invalid", func(t *testing.T) {
+		assert.PanicsWithValue(t, "template: MustFunc: string is not a function", func() { MustFunc("user") })
+		assert.PanicsWithValue(t, "template: MustFunc: func() (string, int) must return a single value, or a value and an error", func() {
+			MustFunc(func() (string, int) { return "", 0 })
+		})
+		assert.PanicsWithValue(t, "template: MustFunc: func() must return a single value, or a value and an error", func() {
+			MustFunc(func() {})
+		})
+	})
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/funcs",
+			FuncMaps: []gotemplate.FuncMap{
+				{
+					"user": MustFunc(func(id int) (string, error) {
+						if id <= 0 {
+							return "", errors.New("user does not exist")
+						}
+						return "Joe", nil
+					}),
+				},
+			},
+		},
+	))
+	f.Get("/{id}", func(c flamego.Context, t Template, data Data) {
+		data["ID"] = c.ParamInt("id")
+		t.HTML(http.StatusOK, "user")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/1", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<p>Joe</p>", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/0", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Contains(t, resp.Body.String(), `executing "user"`)
+	assert.Contains(t, resp.Body.String(), "error calling user: user does not exist")
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	got, err := parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16", "::1"})
+	require.Nil(t, err)
+	require.Len(t, got, 3)
+	assert.Equal(t, "10.0.0.1/32", got[0].String())
+	assert.Equal(t, "192.168.0.0/16", got[1].String())
+	assert.Equal(t, "::1/128", got[2].String())
+
+	_, err = parseTrustedProxies([]string{"localhost"})
+	assert.Equal(t, `invalid IP address "localhost"`, err.Error())
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	require.NotNil(t, err)
+}
+
+func TestBaseURL(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	require.Nil(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "203.0.113.1:1234",
+			want:       "http://example.com",
+		},
+		{
+			name:       "untrusted proxy",
+			remoteAddr: "203.0.113.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "evil.com",
+			},
+			want: "http://example.com",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "flamego.dev",
+			},
+			want: "https://flamego.dev",
+		},
+		{
+			name:       "multiple proxies",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "HTTPS, http",
+				"X-Forwarded-Host":  "flamego.dev, 10.0.0.2",
+			},
+			want: "https://flamego.dev",
+		},
+		{
+			name:       "invalid proto",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "javascript",
+			},
+			want: "http://example.com",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, test.want, baseURL(r, trustedProxies))
+		})
+	}
+}
+
+func TestURLFuncs(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory:      "testdata/url",
+			WithURLFuncs:   true,
+			TrustedProxies: []string{"10.0.0.1"},
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `<link rel="canonical" href="https://example.com/about">`, resp.Body.String())
+
+	t.Run("invalid trusted proxies", func(t *testing.T) {
+		_, err := NewEngine(
+			Options{
+				Directory:      "testdata/url",
+				WithURLFuncs:   true,
+				TrustedProxies: []string{"localhost"},
+			},
+		)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "parse trusted proxies")
+	})
+}
+
+func TestPagination(t *testing.T) {
+	tests := []struct {
+		name        string
+		page        int
+		perPage     int
+		total       int
+		size        int
+		wantPages   int
+		wantRange   []int
+		wantHasPrev bool
+		wantHasNext bool
+	}{
+		{
+			name:      "no item",
+			page:      1,
+			perPage:   10,
+			total:     0,
+			size:      5,
+			wantPages: 0,
+			wantRange: []int{},
+		},
+		{
+			name:      "zero per page",
+			page:      1,
+			perPage:   0,
+			total:     10,
+			size:      5,
+			wantPages: 0,
+			wantRange: []int{},
+		},
+		{
+			name:      "single page",
+			page:      1,
+			perPage:   10,
+			total:     10,
+			size:      5,
+			wantPages: 1,
+			wantRange: []int{1},
+		},
+		{
+			name:        "page 0",
+			page:        0,
+			perPage:     10,
+			total:       100,
+			size:        5,
+			wantPages:   10,
+			wantRange:   []int{1, 2, 3, 4, 5},
+			wantHasNext: true,
+		},
+		{
+			name:        "first page",
+			page:        1,
+			perPage:     10,
+			total:       95,
+			size:        5,
+			wantPages:   10,
+			wantRange:   []int{1, 2, 3, 4, 5},
+			wantHasNext: true,
+		},
+		{
+			name:        "middle page",
+			page:        5,
+			perPage:     10,
+			total:       100,
+			size:        5,
+			wantPages:   10,
+			wantRange:   []int{3, 4, 5, 6, 7},
+			wantHasPrev: true,
+			wantHasNext: true,
+		},
+		{
+			name:        "even size",
+			page:        5,
+			perPage:     10,
+			total:       100,
+			size:        4,
+			wantPages:   10,
+			wantRange:   []int{4, 5, 6, 7},
+			wantHasPrev: true,
+			wantHasNext: true,
+		},
+		{
+			name:        "last page",
+			page:        10,
+			perPage:     10,
+			total:       100,
+			size:        5,
+			wantPages:   10,
+			wantRange:   []int{6, 7, 8, 9, 10},
+			wantHasPrev: true,
+		},
+		{
+			name:        "beyond last page",
+			page:        20,
+			perPage:     10,
+			total:       100,
+			size:        5,
+			wantPages:   10,
+			wantRange:   []int{6, 7, 8, 9, 10},
+			wantHasPrev: true,
+		},
+		{
+			name:        "size larger than pages",
+			page:        2,
+			perPage:     10,
+			total:       30,
+			size:        5,
+			wantPages:   3,
+			wantRange:   []int{1, 2, 3},
+			wantHasPrev: true,
+			wantHasNext: true,
+		},
+		{
+			name:        "zero size",
+			page:        2,
+			perPage:     10,
+			total:       30,
+			size:        0,
+			wantPages:   3,
+			wantRange:   []int{},
+			wantHasPrev: true,
+			wantHasNext: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.wantPages, pages(test.perPage, test.total))
+			assert.Equal(t, test.wantRange, pageRange(test.page, test.perPage, test.total, test.size))
+			assert.Equal(t, test.wantHasPrev, hasPrev(test.page, test.perPage, test.total))
+			assert.Equal(t, test.wantHasNext, hasNext(test.page, test.perPage, test.total))
+		})
+	}
+}
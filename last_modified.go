@@ -0,0 +1,91 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	gotemplate "html/template"
+	"net/http"
+	"time"
+)
+
+// modTimes returns the newest modification time among each template and the
+// templates it depends on, by the name of templates. Templates that depend on
+// any template with unknown modification time are omitted. It must be called
+// before the set is executed, because html/template rewrites parse trees on
+// first execution.
+func modTimes(set *templateSet) map[string]time.Time {
+	bySource := make(map[string]time.Time, len(set.srcs))
+	for _, src := range set.srcs {
+		bySource[src.name] = src.modTime
+	}
+
+	times := make(map[string]time.Time, len(set.srcs))
+	for _, src := range set.srcs {
+		tpl, root := set.html, src.name
+		if l := set.layouts[src.name]; l != nil {
+			tpl, root = l.tpl, l.root
+		}
+
+		modTime, ok := newestModTime(tpl, root, bySource)
+		if ok {
+			times[src.name] = modTime
+		}
+	}
+	return times
+}
+
+// newestModTime walks the named template and the templates it references via
+// the "template" action, or the "include" and "render" functions, and returns
+// the newest modification time of the sources they are parsed from.
+func newestModTime(tpl *gotemplate.Template, name string, bySource map[string]time.Time) (time.Time, bool) {
+	var newest time.Time
+	seen := make(map[string]bool)
+	queue := []string{name}
+	for len(queue) > 0 {
+		name, queue = queue[0], queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		t := tpl.Lookup(name)
+		if t == nil || t.Tree == nil {
+			continue
+		}
+
+		modTime := bySource[t.Tree.ParseName]
+		if modTime.IsZero() {
+			return time.Time{}, false
+		} else if modTime.After(newest) {
+			newest = modTime
+		}
+		queue = referencedTemplates(t.Tree.Root, queue)
+	}
+	return newest, true
+}
+
+// isConditional returns true if the request is a GET or HEAD request that
+// revalidates a cached copy with the "If-None-Match" or "If-Modified-Since"
+// header.
+func isConditional(r *http.Request) bool {
+	if r == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// notModified returns true if the "If-Modified-Since" header of the request is
+// not older than the modification time.
+func notModified(r *http.Request, modTime time.Time) bool {
+	if r == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/flamego/flamego"
+)
+
+func TestTemplate_LastModified(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []struct {
+		name    string
+		content string
+		modTime time.Time
+	}{
+		{"base.tmpl", `<html>{{block "content" .}}{{end}}</html>`, base},
+		{"page.tmpl", "{{extends \"base\"}}\n{{define \"content\"}}{{template \"greeting\" .}}{{end}}", base.Add(time.Hour)},
+		{"greeting.tmpl", `Hello!`, base.Add(2 * time.Hour)},
+		{"included.tmpl", `{{if true}}{{include "base" .}}{{end}}`, base.Add(-time.Hour)},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		require.Nil(t, os.WriteFile(path, []byte(f.content), 0644))
+		require.Nil(t, os.Chtimes(path, f.modTime, f.modTime))
+	}
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory:    dir,
+			LastModified: true,
+			CacheMaxAge:  time.Hour,
+		},
+	))
+	f.Get("/{name}", func(c flamego.Context, t Template) {
+		t.HTML(http.StatusOK, c.Param("name"))
+	})
+
+	tests := []struct {
+		name             string
+		ifModifiedSince  time.Time
+		wantCode         int
+		wantLastModified time.Time
+	}{
+		{
+			name:             "base",
+			wantCode:         http.StatusOK,
+			wantLastModified: base,
+		},
+		{
+			name:             "page",
+			wantCode:         http.StatusOK,
+			wantLastModified: base.Add(2 * time.Hour),
+		},
+		{
+			name:             "included",
+			wantCode:         http.StatusOK,
+			wantLastModified: base,
+		},
+		{
+			name:             "page",
+			ifModifiedSince:  base.Add(time.Hour),
+			wantCode:         http.StatusOK,
+			wantLastModified: base.Add(2 * time.Hour),
+		},
+		{
+			name:             "page",
+			ifModifiedSince:  base.Add(2 * time.Hour),
+			wantCode:         http.StatusNotModified,
+			wantLastModified: base.Add(2 * time.Hour),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/"+test.name, nil)
+			require.Nil(t, err)
+			if !test.ifModifiedSince.IsZero() {
+				req.Header.Set("If-Modified-Since", test.ifModifiedSince.Format(http.TimeFormat))
+			}
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			assert.Equal(t, test.wantLastModified.Format(http.TimeFormat), resp.Header().Get("Last-Modified"))
+			assert.Equal(t, "max-age=3600", resp.Header().Get("Cache-Control"))
+			if test.wantCode == http.StatusNotModified {
+				assert.Empty(t, resp.Body.String())
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		path := filepath.Join(dir, "broken.tmpl")
+		require.Nil(t, os.WriteFile(path, []byte(`{{index .Missing 1}}`), 0644))
+		require.Nil(t, os.Chtimes(path, base, base))
+		defer func() { _ = os.Remove(path) }()
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/broken", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Empty(t, resp.Header().Get("Last-Modified"))
+		assert.Empty(t, resp.Header().Get("Cache-Control"))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		e, err := NewEngine(
+			Options{
+				Directory:    dir,
+				LastModified: true,
+			},
+		)
+		require.Nil(t, err)
+		require.Nil(t, e.AddTemplate("runtime", `{{template "greeting"}}`))
+
+		f := flamego.NewWithLogger(&bytes.Buffer{})
+		f.Use(e.Handler())
+		f.Get("/", func(t Template) {
+			t.HTML(http.StatusOK, "runtime")
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "Hello!", resp.Body.String())
+		assert.Empty(t, resp.Header().Get("Last-Modified"))
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	gotemplate "html/template"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// splitExtends returns the name of the parent layout declared by the leading
+// `{{ extends "name" }}` directive of the template, and the rest of the
+// template with the directive stripped. The parent is empty when there is no
+// such directive.
+func splitExtends(data []byte, delims Delims) (parent string, body []byte) {
+	left, right := delims.Left, delims.Right
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+
+	re := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(left) + `-?\s*extends\s+"([^"]+)"\s*-?` + regexp.QuoteMeta(right) + `\r?\n?`)
+	m := re.FindSubmatchIndex(data)
+	if m == nil {
+		return "", data
+	}
+	return string(data[m[2]:m[3]]), data[m[1]:]
+}
+
+// layout is a template that extends other templates. It has its own template
+// set where blocks of ancestors are overridden by their descendants.
+type layout struct {
+	tpl  *gotemplate.Template
+	root string // The name of the outermost ancestor, which is the one to execute
+}
+
+// layoutChain returns the chain of templates that the named template extends,
+// starting from the template itself to the outermost ancestor. It returns an
+// error if the chain is cyclic or references an unknown template.
+func layoutChain(name string, parents map[string]string, known map[string]bool) ([]string, error) {
+	chain := []string{name}
+	seen := map[string]bool{name: true}
+	for {
+		parent, ok := parents[chain[len(chain)-1]]
+		if !ok {
+			return chain, nil
+		}
+
+		if seen[parent] {
+			return nil, errors.Errorf("cyclic layout chain: %s -> %s", strings.Join(chain, " -> "), parent)
+		} else if !known[parent] {
+			return nil, errors.Errorf("template %q extends unknown template %q", chain[len(chain)-1], parent)
+		}
+		seen[parent] = true
+		chain = append(chain, parent)
+	}
+}
+
+// parseLayouts builds a template set for each template that extends another
+// template. The base is cloned for every such template, then the chain is
+// parsed from the outermost ancestor to the template itself so that blocks
+// defined by descendants take precedence.
+//
+// The association rules of blocks are thus:
+//   - A `{{block "name" .}}default{{end}}` renders the default content unless
+//     the template being rendered or any of its ancestors closer to it defines
+//     "name", in which case the closest definition wins.
+//   - Definitions of a template that extends others are only visible within its
+//     own set, and never affect other templates extending the same ancestors.
+//   - Definitions of a template that does not extend others are shared by all
+//     templates as with the standard library, and replace the block of the same
+//     name depending on the order of parsing, thus should not be used to
+//     override blocks.
+//   - Content of an extending template outside of "define" and "block" actions
+//     is never rendered, because the outermost ancestor is the one to execute.
+func parseLayouts(opts Options, base *gotemplate.Template, srcs []source) (map[string]*layout, error) {
+	parents := make(map[string]string)
+	bodies := make(map[string][]byte, len(srcs))
+	delims := make(map[string]Delims, len(srcs))
+	known := make(map[string]bool, len(srcs))
+	for _, src := range srcs {
+		var data []byte
+		delims[src.name], data = splitDelims(src.data, opts.Delims)
+		parent, body := splitExtends(data, delims[src.name])
+		parent = normalizeName(opts, parent)
+		if parent != "" {
+			parents[src.name] = parent
+		} else {
+			delete(parents, src.name)
+		}
+		bodies[src.name] = body
+		known[src.name] = true
+	}
+
+	layouts := make(map[string]*layout, len(parents))
+	for name := range parents {
+		chain, err := layoutChain(name, parents, known)
+		if err != nil {
+			return nil, err
+		}
+
+		tpl, err := base.Clone()
+		if err != nil {
+			return nil, errors.Wrapf(err, "clone for %q", name)
+		}
+		bindInclude(opts, tpl, nil)
+
+		for i := len(chain) - 1; i >= 0; i-- {
+			d := delims[chain[i]]
+			_, err = tpl.New(chain[i]).Delims(d.Left, d.Right).Parse(string(bodies[chain[i]]))
+			if err != nil {
+				return nil, newParseError(chain[i], err)
+			}
+		}
+
+		layouts[name] = &layout{
+			tpl:  tpl,
+			root: chain[len(chain)-1],
+		}
+	}
+	return layouts, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/flamego/flamego"
+)
+
+func TestSplitExtends(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		delims     Delims
+		wantParent string
+		wantBody   string
+	}{
+		{
+			name:     "no directive",
+			data:     `<p>{{.Name}}</p>`,
+			wantBody: `<p>{{.Name}}</p>`,
+		},
+		{
+			name:       "directive",
+			data:       "{{ extends \"base\" }}\n{{define \"content\"}}{{end}}",
+			wantParent: "base",
+			wantBody:   `{{define "content"}}{{end}}`,
+		},
+		{
+			name:       "trim markers",
+			data:       "{{- extends \"layouts/base\" -}}{{define \"content\"}}{{end}}",
+			wantParent: "layouts/base",
+			wantBody:   `{{define "content"}}{{end}}`,
+		},
+		{
+			name:       "custom delimiters",
+			data:       "[[extends \"base\"]]\n[[define \"content\"]][[end]]",
+			delims:     Delims{Left: "[[", Right: "]]"},
+			wantParent: "base",
+			wantBody:   `[[define "content"]][[end]]`,
+		},
+		{
+			name:     "not leading",
+			data:     `<p></p>{{extends "base"}}`,
+			wantBody: `<p></p>{{extends "base"}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parent, body := splitExtends([]byte(test.data), test.delims)
+			assert.Equal(t, test.wantParent, parent)
+			assert.Equal(t, test.wantBody, string(body))
+		})
+	}
+}
+
+func TestTemplate_HTML_Layouts(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(Options{Directory: "testdata/layouts/valid"}))
+	f.Get("/{name}", func(c flamego.Context, t Template, data Data) {
+		data["Name"] = "Flamego"
+		t.HTML(http.StatusOK, c.Param("name"))
+	})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{
+			name: "base",
+			want: "<html>base content</html>\n",
+		},
+		{
+			name: "section",
+			want: "<html><section>section default</section></html>\n",
+		},
+		{
+			name: "page",
+			want: "<html><section>Hello, Flamego!</section></html>\n",
+		},
+		{
+			name: "about",
+			want: "<html>About</html>\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/"+test.name, nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusOK, resp.Code)
+
+			want := test.want
+			if runtime.GOOS == "windows" {
+				want = strings.ReplaceAll(want, "\n", "\r\n")
+			}
+			assert.Equal(t, want, resp.Body.String())
+		})
+	}
+}
+
+func TestTemplate_HTML_LayoutBlocks(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(Options{Directory: "testdata/layouts/blocks"}))
+	f.Get("/{name}", func(c flamego.Context, t Template, data Data) {
+		data["Name"] = "Flamego"
+		t.HTML(http.StatusOK, c.Param("name"))
+	})
+
+	flamego.SetEnv(flamego.EnvTypeProd)
+	defer flamego.SetEnv(flamego.EnvTypeDev)
+
+	// The order matters to make sure that blocks overridden by one template do
+	// not leak into others.
+	tests := []struct {
+		name string
+		want string
+	}{
+		{
+			name: "base",
+			want: "<html><aside>default sidebar</aside><main>default content</main></html>",
+		},
+		{
+			name: "override",
+			want: "<html><aside>Flamego sidebar</aside><main>override content</main></html>",
+		},
+		{
+			name: "partial",
+			want: "<html><aside>default sidebar</aside><main>partial content</main></html>",
+		},
+		{
+			name: "nested",
+			want: "<html><aside>nested sidebar</aside><main>override content</main></html>",
+		},
+		{
+			name: "base",
+			want: "<html><aside>default sidebar</aside><main>default content</main></html>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/"+test.name, nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, test.want, resp.Body.String())
+		})
+	}
+}
+
+func TestNewEngine_CyclicLayouts(t *testing.T) {
+	_, err := NewEngine(Options{Directory: "testdata/layouts/cyclic"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cyclic layout chain")
+}
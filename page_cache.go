@@ -0,0 +1,89 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/flamego/flamego"
+)
+
+// pageCall is an in-flight rendering of a page to be cached, which concurrent
+// requests of the same page wait for instead of rendering on their own.
+type pageCall struct {
+	done  chan struct{}
+	entry []byte // The cache entry of the rendered page, only set on success
+}
+
+// pageCalls is the group of in-flight renderings of pages to be cached.
+type pageCalls struct {
+	lock  sync.Mutex
+	calls map[string]*pageCall
+}
+
+// start returns the in-flight call of the key, and true if the caller is the
+// one to render and must call finish afterwards.
+func (g *pageCalls) start(key string) (*pageCall, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if call, ok := g.calls[key]; ok {
+		return call, false
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*pageCall)
+	}
+	call := &pageCall{done: make(chan struct{})}
+	g.calls[key] = call
+	return call, true
+}
+
+// finish completes the call of the key with the cache entry, which is nil when
+// rendering failed.
+func (g *pageCalls) finish(key string, call *pageCall, entry []byte) {
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+
+	call.entry = entry
+	close(call.done)
+}
+
+// encodePage returns the cache entry of a page with the content type and the
+// body.
+func encodePage(contentType string, body []byte) []byte {
+	entry := make([]byte, 0, len(contentType)+1+len(body))
+	entry = append(entry, contentType...)
+	entry = append(entry, '\n')
+	return append(entry, body...)
+}
+
+// decodePage returns the content type and the body of a cache entry, or false
+// if the entry is malformed.
+func decodePage(entry []byte) (contentType string, body []byte, ok bool) {
+	i := bytes.IndexByte(entry, '\n')
+	if i < 0 {
+		return "", nil, false
+	}
+	return string(entry[:i]), entry[i+1:], true
+}
+
+// recordingResponseWriter is a flamego.ResponseWriter that records the body
+// written to the underlying writer.
+type recordingResponseWriter struct {
+	flamego.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	// The underlying writer does not write the body for HEAD requests, which
+	// still needs to be recorded in full.
+	if err == nil {
+		w.body.Write(p)
+	}
+	return n, err
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"errors"
+	gotemplate "html/template"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/flamego/flamego"
+)
+
+func TestTemplate_HTMLCached(t *testing.T) {
+	var renders int32
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/concurrency",
+			FuncMaps: []gotemplate.FuncMap{
+				{
+					"wait": func() (string, error) {
+						n := atomic.AddInt32(&renders, 1)
+						if n == 1 {
+							return "", errors.New("not ready")
+						}
+						return strconv.Itoa(int(n)), nil
+					},
+				},
+			},
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTMLCached(http.StatusCreated, "home", "v1", time.Minute)
+	})
+
+	get := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Failed responses are not cached.
+	resp := get()
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+
+	resp = get()
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, "<p>2</p>", resp.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+
+	resp = get()
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, "<p>2</p>", resp.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&renders))
+}
+
+func TestTemplate_HTMLCached_Stampede(t *testing.T) {
+	var renders int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/concurrency",
+			FuncMaps: []gotemplate.FuncMap{
+				{
+					"wait": func() string {
+						if atomic.AddInt32(&renders, 1) == 1 {
+							close(started)
+						}
+						<-release
+						return "done"
+					},
+				},
+			},
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTMLCached(http.StatusOK, "home", "v1", time.Minute)
+	})
+
+	const n = 10
+	resps := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	serve := func(i int) {
+		defer wg.Done()
+		resps[i] = httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		f.ServeHTTP(resps[i], req)
+	}
+
+	wg.Add(1)
+	go serve(0)
+	<-started
+	// Requests arriving during the rendering wait for it.
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go serve(i)
+	}
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&renders))
+	for _, resp := range resps {
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "<p>done</p>", resp.Body.String())
+	}
+}
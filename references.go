@@ -0,0 +1,168 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	gotemplate "html/template"
+	"sort"
+	"text/template/parse"
+
+	"github.com/pkg/errors"
+)
+
+// referencedTemplates appends names of templates referenced by the node to the
+// list and returns the extended list.
+func referencedTemplates(node parse.Node, names []string) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return names
+		}
+		for _, node := range n.Nodes {
+			names = referencedTemplates(node, names)
+		}
+	case *parse.TemplateNode:
+		names = append(names, n.Name)
+	case *parse.ActionNode:
+		names = referencedTemplates(n.Pipe, names)
+	case *parse.IfNode:
+		names = referencedBranchTemplates(&n.BranchNode, names)
+	case *parse.RangeNode:
+		names = referencedBranchTemplates(&n.BranchNode, names)
+	case *parse.WithNode:
+		names = referencedBranchTemplates(&n.BranchNode, names)
+	case *parse.PipeNode:
+		if n == nil {
+			return names
+		}
+		for _, cmd := range n.Cmds {
+			if len(cmd.Args) >= 2 {
+				ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+				str, isString := cmd.Args[1].(*parse.StringNode)
+				if ok && isString && (ident.Ident == "include" || ident.Ident == "render") {
+					names = append(names, str.Text)
+				}
+			}
+			for _, arg := range cmd.Args {
+				names = referencedTemplates(arg, names)
+			}
+		}
+	}
+	return names
+}
+
+func referencedBranchTemplates(n *parse.BranchNode, names []string) []string {
+	names = referencedTemplates(n.Pipe, names)
+	names = referencedTemplates(n.List, names)
+	return referencedTemplates(n.ElseList, names)
+}
+
+// callsNested returns true if the node calls the "include" or "render"
+// functions, which need to be bound per execution.
+func callsNested(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, node := range n.Nodes {
+			if callsNested(node) {
+				return true
+			}
+		}
+	case *parse.IdentifierNode:
+		return n.Ident == "include" || n.Ident == "render"
+	case *parse.TemplateNode:
+		return callsNested(n.Pipe)
+	case *parse.ActionNode:
+		return callsNested(n.Pipe)
+	case *parse.IfNode:
+		return branchCallsNested(&n.BranchNode)
+	case *parse.RangeNode:
+		return branchCallsNested(&n.BranchNode)
+	case *parse.WithNode:
+		return branchCallsNested(&n.BranchNode)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				if callsNested(arg) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func branchCallsNested(n *parse.BranchNode) bool {
+	return callsNested(n.Pipe) || callsNested(n.List) || callsNested(n.ElseList)
+}
+
+// setCallsNested returns true if any template of the set, including those that
+// extend others, calls the "include" or "render" functions.
+func setCallsNested(set *templateSet) bool {
+	calls := func(tpl *gotemplate.Template) bool {
+		for _, t := range tpl.Templates() {
+			if t.Tree != nil && callsNested(t.Tree.Root) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if calls(set.html) {
+		return true
+	}
+	for _, l := range set.layouts {
+		if calls(l.tpl) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReferences returns errors of templates that reference undefined
+// templates via the "template" action, or the "include" and "render" functions.
+func checkReferences(set *templateSet) error {
+	var errs multiError
+	seen := make(map[string]bool)
+	check := func(tpl *gotemplate.Template) {
+		templates := tpl.Templates()
+		sort.Slice(templates, func(i, j int) bool { return templates[i].Name() < templates[j].Name() })
+		for _, t := range templates {
+			if t.Tree == nil {
+				continue
+			}
+
+			for _, name := range referencedTemplates(t.Tree.Root, nil) {
+				if ref := tpl.Lookup(name); ref != nil && ref.Tree != nil {
+					continue
+				} else if set.layouts[name] != nil {
+					continue
+				}
+
+				err := errors.Errorf("template %q in %q references undefined template %q", t.Name(), t.Tree.ParseName, name)
+				if !seen[err.Error()] {
+					seen[err.Error()] = true
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+
+	check(set.html)
+	names := make([]string, 0, len(set.layouts))
+	for name := range set.layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		check(set.layouts[name].tpl)
+	}
+	return errs.err()
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckReferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr string
+	}{
+		{
+			name: "valid",
+			opts: Options{Directory: "testdata/layouts/valid", CheckReferences: true},
+		},
+		{
+			name: "not checked",
+			opts: Options{Directory: "testdata/references"},
+		},
+		{
+			name: "dangling",
+			opts: Options{Directory: "testdata/references", CheckReferences: true},
+			wantErr: `check references: template "footer" in "footer" references undefined template "gone"` + "\n" +
+				`template "home" in "home" references undefined template "missing"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewEngine(test.opts)
+			if test.wantErr == "" {
+				require.Nil(t, err)
+				return
+			}
+			require.NotNil(t, err)
+			assert.Equal(t, test.wantErr, err.Error())
+		})
+	}
+}
+
+func TestCallsNested(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{
+			name:    "text",
+			content: `<p>Rendered {{.Count}} times, see the included notes.</p>`,
+			want:    false,
+		},
+		{
+			name:    "string",
+			content: `{{printf "%s" "include"}}`,
+			want:    false,
+		},
+		{
+			name:    "field",
+			content: `{{.render}}`,
+			want:    false,
+		},
+		{
+			name:    "include",
+			content: `{{include "header" .}}`,
+			want:    true,
+		},
+		{
+			name:    "render in argument",
+			content: `{{printf "%s" (render "header" .)}}`,
+			want:    true,
+		},
+		{
+			name:    "branch",
+			content: `{{if .Show}}{{else}}{{range .Items}}{{include "item" .}}{{end}}{{end}}`,
+			want:    true,
+		},
+		{
+			name:    "define",
+			content: `{{define "body"}}{{with .}}{{render "item" .}}{{end}}{{end}}`,
+			want:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := NewEngine(
+				Options{
+					FileSystem: &memoryFileSystem{NewFile("home", []byte(test.content), ".tmpl")},
+				},
+			)
+			require.Nil(t, err)
+			assert.Equal(t, test.want, e.current().usesNesting)
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultReloadInterval is the default of Options.ReloadInterval.
+const defaultReloadInterval = 5 * time.Second
+
+// fileChecksum is the checksum of a file along with the stat it is computed
+// for.
+type fileChecksum struct {
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte
+}
+
+// checksums computes the combined checksum of template files on disk, files
+// are only re-read when their modification times or sizes have changed.
+type checksums struct {
+	files map[string]fileChecksum // The path to checksum of files seen last time
+}
+
+// sum returns the combined checksum of template files in the directories that
+// templates are loaded from with the options. Directories that do not exist
+// are skipped.
+func (c *checksums) sum(opts Options) ([]byte, error) {
+	files := make(map[string]fileChecksum, len(c.files))
+	h := sha256.New()
+	for _, dir := range sourceDirs(opts) {
+		if !isDir(dir) {
+			continue
+		}
+
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			} else if d.IsDir() {
+				return nil
+			}
+			if _, ok := matchExt(path, opts.Extensions); !ok {
+				return nil
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return errors.Wrapf(err, "stat %q", path)
+			}
+
+			f, ok := c.files[path]
+			if !ok || !f.modTime.Equal(fi.ModTime()) || f.size != fi.Size() {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return errors.Wrapf(err, "read %q", path)
+				}
+				f = fileChecksum{
+					modTime: fi.ModTime(),
+					size:    fi.Size(),
+					sum:     sha256.Sum256(data),
+				}
+			}
+			files[path] = f
+
+			_, _ = h.Write([]byte(path))
+			_, _ = h.Write(f.sum[:])
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "walk %q", dir)
+		}
+	}
+	c.files = files
+	return h.Sum(nil), nil
+}
+
+// sourceDirs returns the list of directories that templates are loaded from
+// with the options, in the order of loading.
+func sourceDirs(opts Options) []string {
+	var dirs []string
+	if opts.FileSystem == nil {
+		dirs = append(dirs, opts.Directory)
+	}
+	dirs = append(dirs, opts.AppendDirectories...)
+
+	namespaces := make([]string, 0, len(opts.Roots))
+	for ns := range opts.Roots {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		dirs = append(dirs, opts.Roots[ns])
+	}
+	return dirs
+}
+
+// reloadIfChanged recompiles templates when the combined checksum of template
+// files has changed since the last check, which is done at most once per
+// Options.ReloadInterval. It returns the current template set, which is the
+// previous one when recompiling fails.
+func (e *Engine) reloadIfChanged() (*templateSet, error) {
+	// Requests keep being served by the current set while a check is in progress.
+	if !e.reloadLock.TryLock() {
+		return e.current(), nil
+	}
+	defer e.reloadLock.Unlock()
+
+	interval := e.opts.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	if time.Since(e.reloadChecked) < interval {
+		return e.current(), nil
+	}
+	e.reloadChecked = time.Now()
+
+	sum, err := e.checksums.sum(e.opts)
+	if err != nil {
+		return e.current(), errors.Wrap(err, "checksum")
+	} else if bytes.Equal(sum, e.checksum) {
+		return e.current(), nil
+	}
+
+	// Templates are compiled under the read lock to keep serving requests, and the
+	// write lock is only taken to swap the set. The compilation is retried when
+	// AddTemplate, RemoveTemplate or SetFuncs has changed the engine in between,
+	// so that their changes are not lost.
+	for {
+		e.lock.RLock()
+		generation := e.generation
+		set, err := e.compile()
+		e.lock.RUnlock()
+		if err != nil {
+			// The checksum is kept unchanged to retry on the next check.
+			return e.current(), errors.Wrap(err, "recompile")
+		}
+
+		e.lock.Lock()
+		if e.generation != generation {
+			e.lock.Unlock()
+			continue
+		}
+		e.set = set
+		e.lock.Unlock()
+
+		e.checksum = sum
+		e.logger.Info("Templates are reloaded")
+		return set, nil
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Flamego. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package template
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/flamego/flamego"
+)
+
+func TestEngine_ReloadOnChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "home.tmpl")
+	require.Nil(t, os.WriteFile(path, []byte("<p>v1</p>"), 0644))
+
+	e, err := NewEngine(
+		Options{
+			Directory:        dir,
+			ReloadOnChecksum: true,
+			ReloadInterval:   time.Nanosecond,
+		},
+	)
+	require.Nil(t, err)
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(e.Handler())
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+
+	flamego.SetEnv(flamego.EnvTypeProd)
+	defer flamego.SetEnv(flamego.EnvTypeDev)
+
+	render := func() string {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+		return resp.Body.String()
+	}
+	assert.Equal(t, "<p>v1</p>", render())
+
+	// Nothing is recompiled when files are not changed.
+	set := e.current()
+	_, err = e.reloadIfChanged()
+	require.Nil(t, err)
+	assert.Same(t, set, e.current())
+
+	require.Nil(t, e.AddTemplate("extra", "<p>extra</p>"))
+	require.Nil(t, os.WriteFile(path, []byte("<p>v2</p>"), 0644))
+	// Make sure the modification time differs on file systems with coarse
+	// timestamps.
+	modTime := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(path, modTime, modTime))
+	assert.Equal(t, "<p>v2</p>", render())
+	assert.True(t, e.HasTemplate("extra"))
+
+	// The previous set is kept when recompiling fails.
+	require.Nil(t, os.WriteFile(path, []byte("{{"), 0644))
+	require.Nil(t, os.Chtimes(path, modTime.Add(time.Minute), modTime.Add(time.Minute)))
+	assert.Equal(t, "<p>v2</p>", render())
+}
+
+func TestEngine_ReloadOnChecksum_Concurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "home.tmpl")
+	require.Nil(t, os.WriteFile(path, []byte("<p>v0</p>"), 0644))
+
+	e, err := NewEngine(
+		Options{
+			Directory:        dir,
+			ReloadOnChecksum: true,
+			ReloadInterval:   time.Nanosecond,
+		},
+	)
+	require.Nil(t, err)
+
+	// Templates added while reloading are kept by the reloaded set.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 20; i++ {
+			_ = os.WriteFile(path, []byte("<p>v"+strconv.Itoa(i)+"</p>"), 0644)
+			modTime := time.Now().Add(time.Duration(i) * time.Minute)
+			_ = os.Chtimes(path, modTime, modTime)
+			_, _ = e.reloadIfChanged()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		name := "extra" + strconv.Itoa(i)
+		require.Nil(t, e.AddTemplate(name, "<p>extra</p>"))
+		for j := 0; j <= i; j++ {
+			require.True(t, e.HasTemplate("extra"+strconv.Itoa(j)), "extra%d", j)
+		}
+	}
+	<-done
+}
+
+func TestChecksums(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "home.tmpl")
+	require.Nil(t, os.WriteFile(path, []byte("<p>v1</p>"), 0644))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("readme"), 0644))
+
+	opts := Options{
+		Directory:  dir,
+		Extensions: []string{".tmpl"},
+	}
+	var c checksums
+	sum1, err := c.sum(opts)
+	require.Nil(t, err)
+	assert.Len(t, c.files, 1)
+
+	// Files of other extensions are not considered.
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("changed"), 0644))
+	sum2, err := c.sum(opts)
+	require.Nil(t, err)
+	assert.Equal(t, sum1, sum2)
+
+	// Files are not re-read when their modification times and sizes are unchanged.
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(path, []byte("<p>v2</p>"), 0644))
+	require.Nil(t, os.Chtimes(path, fi.ModTime(), fi.ModTime()))
+	sum3, err := c.sum(opts)
+	require.Nil(t, err)
+	assert.Equal(t, sum1, sum3)
+
+	require.Nil(t, os.Chtimes(path, fi.ModTime().Add(time.Minute), fi.ModTime().Add(time.Minute)))
+	sum4, err := c.sum(opts)
+	require.Nil(t, err)
+	assert.NotEqual(t, sum1, sum4)
+}
+
+func TestEngine_ReloadOnChecksum_NonBlocking(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "home.tmpl")
+	require.Nil(t, os.WriteFile(path, []byte("<p>v1</p>"), 0644))
+
+	var block int32
+	compiling := make(chan struct{})
+	release := make(chan struct{})
+	e, err := NewEngine(
+		Options{
+			Directory:        dir,
+			ReloadOnChecksum: true,
+			ReloadInterval:   time.Nanosecond,
+			NameFunc: func(name, ext string) string {
+				if atomic.CompareAndSwapInt32(&block, 1, 0) {
+					close(compiling)
+					<-release
+				}
+				return name[:len(name)-len(ext)]
+			},
+		},
+	)
+	require.Nil(t, err)
+
+	require.Nil(t, os.WriteFile(path, []byte("<p>v2</p>"), 0644))
+	modTime := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(path, modTime, modTime))
+
+	atomic.StoreInt32(&block, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := e.reloadIfChanged()
+		assert.Nil(t, err)
+	}()
+	<-compiling
+
+	// Templates are still accessible while recompiling.
+	assert.True(t, e.HasTemplate("home"))
+	src, ok := e.Source("home")
+	assert.True(t, ok)
+	assert.Equal(t, "<p>v1</p>", string(src))
+
+	close(release)
+	<-done
+	src, ok = e.Source("home")
+	assert.True(t, ok)
+	assert.Equal(t, "<p>v2</p>", string(src))
+}
@@ -6,12 +6,20 @@ package template
 
 import (
 	"bytes"
+	"context"
+	"encoding/xml"
 	"fmt"
 	gotemplate "html/template"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -20,27 +28,306 @@ import (
 	"github.com/flamego/flamego"
 )
 
+// StatusFromTemplate is the status to pass to Template.HTML and alike for
+// using the status set by the "status" function of the template, see
+// Options.WithStatusFunc.
+const StatusFromTemplate = -1
+
 // Template is a Go template rendering engine.
 type Template interface {
 	// HTML renders the named template with the given status.
 	HTML(status int, name string)
+	// HTMLMany renders the named templates in order into a single response with
+	// the given status. Nothing is written to the response if any of them fails.
+	HTMLMany(status int, names ...string)
+	// HTMLWithHeaders is like HTML but also sets the given headers to the
+	// response, which take precedence over Options.Headers.
+	HTMLWithHeaders(status int, name string, headers map[string]string)
+	// HTMLContext is like HTML but renders with the given context instead of the
+	// context of the request, which is returned by the "context" function in
+	// templates when Options.WithContextFunc is enabled, and stops the rendering
+	// once it is canceled.
+	HTMLContext(ctx context.Context, status int, name string)
+	// HTMLErr is like HTML but returns the error of rendering or writing, e.g. the
+	// response is truncated because the client has disconnected, so that the
+	// handler can react to it. The error is handled in the same way as HTML
+	// before being returned, and is a *RenderError when executing the template
+	// fails.
+	HTMLErr(status int, name string) error
+	// HTMLLocalized is like HTML but renders the variant of the named template for
+	// the most preferred language of the "Accept-Language" header of the request
+	// that exists, e.g. "home.zh-CN" or "home.zh" for "zh-CN", falling back to
+	// the variant for Options.DefaultLanguage and then the template itself. The
+	// "Content-Language" header is set to the language of the variant.
+	HTMLLocalized(status int, name string)
+	// HTMLImmutable is like HTML but marks the response as never changing with
+	// "Cache-Control: public, max-age=31536000, immutable", which is meant for
+	// fingerprinted routes. Conditional requests with status 200 are responded
+	// with 304 without rendering because any cached copy is still valid.
+	HTMLImmutable(status int, name string)
+	// HTMLScopes is like HTML but makes the data of each named scope available to
+	// the "scope" function while rendering, so that different regions of a page
+	// read from distinct data, see Options.WithScopeFunc.
+	HTMLScopes(status int, name string, scopes map[string]Data)
+	// OK is a shorthand for HTML(http.StatusOK, name).
+	OK(name string)
+	// Created is a shorthand for HTML(http.StatusCreated, name).
+	Created(name string)
+	// NotFound is a shorthand for HTML(http.StatusNotFound, name).
+	NotFound(name string)
+	// TurboStream renders the named template wrapped in a Hotwire Turbo Stream
+	// element with the given action and target, and responds with the content
+	// type "text/vnd.turbo-stream.html".
+	TurboStream(status int, action, target, name string)
+	// TurboStreams is like TurboStream but renders multiple Turbo Stream
+	// elements in order into a single response.
+	TurboStreams(status int, streams ...TurboStreamAction)
+	// SSE renders the named template as a Server-Sent Event with the optional
+	// event name to an established event stream and flushes it. Every line of the
+	// output is sent as a "data:" field. It does not set any status or headers,
+	// and returns the error of rendering or writing, e.g. the client has
+	// disconnected.
+	SSE(event, name string) error
+	// Stream renders the named template with the given status directly to the
+	// response without buffering, which suits long-running renders like large
+	// exports. The status is written before rendering, thus errors during
+	// rendering can only be logged. The trailers function, when not nil, is
+	// called after rendering to set values of trailers, whose keys must be
+	// declared in the "Trailer" header before calling Stream.
+	Stream(status int, name string, trailers func(header http.Header))
+	// HTMLRaw is like HTML but renders the named template without escaping, e.g.
+	// for generating a downloadable HTML file. It requires
+	// Options.AllowHTMLRaw and must never be used with untrusted data because
+	// the output is vulnerable to XSS. Layouts are not resolved.
+	HTMLRaw(status int, name string)
+	// Text renders the named template with the given status as plain text,
+	// without escaping the output.
+	Text(status int, name string)
+	// XML renders the XML encoding of the value with the given status, which is
+	// prefixed with the standard XML header.
+	XML(status int, v interface{})
+	// Redirect responds with the given 3xx status and the location without
+	// rendering any template. It responds with 500 for other statuses.
+	Redirect(status int, location string)
+	// CachedFragment renders the named template with the data of the request,
+	// and caches the output under the key for the given duration in
+	// Options.FragmentCache. The cached output is returned as long as it is not
+	// expired, regardless of changes of the data, thus the key should identify
+	// the inputs of the fragment.
+	CachedFragment(name, key string, ttl time.Duration) (gotemplate.HTML, error)
+	// HTMLCached is like HTML but caches the rendered response along with its
+	// content type under the key for the given duration in
+	// Options.FragmentCache, and responds with the cached response as long as it
+	// is not expired. Concurrent requests of the same uncached page wait for a
+	// single rendering instead of rendering on their own. Responses other than
+	// the given status (e.g. errors) are not cached, and caching is bypassed when
+	// Options.CSPNonce is set because the nonce differs per request.
+	HTMLCached(status int, name, key string, ttl time.Duration)
+	// Execute renders the named template with the given data to the writer
+	// without setting any status or headers. The data of the request is used
+	// when the given data is nil. The output may be partially written when an
+	// error occurs, which is a *RenderError when executing the template fails.
+	Execute(w io.Writer, name string, data Data) error
+	// RenderTyped renders the named template with the given data and returns the
+	// output as template.HTML, which is not escaped again when composed into
+	// other templates, e.g. as a value of the Data. The data of the request is
+	// used when the given data is nil. The output is always safe in the HTML
+	// context because html/template requires every template to end in it. The
+	// error is a *RenderError when executing the template fails.
+	RenderTyped(name string, data Data) (gotemplate.HTML, error)
+	// Unwrap returns the underlying compiled template set used by the request,
+	// as an escape hatch for behavior not wrapped by this package. It is shared
+	// with other requests, thus mutating it is unsafe while requests are in
+	// flight.
+	Unwrap() *gotemplate.Template
 }
 
 var _ Template = (*template)(nil)
 
 type template struct {
+	c              flamego.Context
 	responseWriter flamego.ResponseWriter
+	request        *http.Request
 	logger         *log.Logger
 
 	*gotemplate.Template
 	Data
+	safeData *SafeData
 
+	opts        *Options
+	set         *templateSet
 	contentType string
-	bufPool     *sync.Pool
+	cspNonce    string
+	bufPool     BufferPool
+	renderSizes *sync.Map       // The key of rendered templates to size of the output
+	pageCalls   *pageCalls      // The in-flight renderings of Template.HTMLCached
+	ctx         context.Context // The context given to HTMLContext, if any
+	renderSem   chan struct{}   // The semaphore of Options.MaxConcurrentRenders, if any
+
+	templateStatus int             // The status set by the "status" function during rendering
+	scopes         map[string]Data // The scopes given to HTMLScopes, if any
+}
+
+func (t *template) Execute(w io.Writer, name string, data Data) error {
+	name, err := t.resolveName(name)
+	if err != nil {
+		return err
+	}
+
+	if data == nil {
+		data = t.renderData()
+	}
+	return t.execute(w, name, data)
+}
+
+func (t *template) RenderTyped(name string, data Data) (gotemplate.HTML, error) {
+	name, err := t.resolveName(name)
+	if err != nil {
+		return "", err
+	}
+
+	if data == nil {
+		data = t.renderData()
+	}
+
+	buf := t.getBuffer()
+	defer t.putBuffer(buf)
+
+	err = t.execute(buf, name, data)
+	if err != nil {
+		return "", err
+	}
+	return gotemplate.HTML(buf.String()), nil
+}
+
+// execute applies the named template to the data, and returns a *RenderError
+// when it fails.
+func (t *template) execute(w io.Writer, name string, data Data) error {
+	err := t.set.execute(w, name, data)
+	if err != nil {
+		return newRenderError(name, err)
+	}
+	return nil
+}
+
+func (t *template) Unwrap() *gotemplate.Template {
+	return t.Template
+}
+
+func (t *template) Redirect(status int, location string) {
+	if status < 300 || status > 399 {
+		t.responseServerError(t.responseWriter, errors.Errorf("invalid redirect status %d", status))
+		return
+	}
+
+	t.responseWriter.Header().Set("Location", location)
+	t.responseWriter.WriteHeader(status)
+}
+
+func (t *template) CachedFragment(name, key string, ttl time.Duration) (gotemplate.HTML, error) {
+	name, err := t.resolveName(name)
+	if err != nil {
+		return "", err
+	}
+
+	// Namespace keys by the template to avoid collisions between fragments.
+	key = name + "\x00" + key
+	if content, ok := t.opts.FragmentCache.Get(key); ok {
+		return gotemplate.HTML(content), nil
+	}
+
+	var buf bytes.Buffer
+	err = t.execute(&buf, name, t.renderData())
+	if err != nil {
+		return "", err
+	}
+	t.opts.FragmentCache.Set(key, buf.Bytes(), ttl)
+	return gotemplate.HTML(buf.String()), nil
+}
+
+func (t *template) HTMLCached(status int, name, key string, ttl time.Duration) {
+	resolved, err := t.resolveName(name)
+	if err != nil {
+		t.responseServerError(t.responseWriter, err)
+		return
+	} else if t.cspNonce != "" {
+		_ = t.renderHTML(status, []string{name}, nil)
+		return
+	}
+
+	// Namespace keys to avoid collisions with fragments, whose names never start
+	// with a NUL.
+	key = "\x00page\x00" + resolved + "\x00" + key
+	if entry, ok := t.opts.FragmentCache.Get(key); ok && t.writeCachedPage(status, resolved, entry) {
+		return
+	}
+
+	call, leader := t.pageCalls.start(key)
+	if !leader {
+		select {
+		case <-call.done:
+		case <-t.context().Done():
+			return
+		}
+		if call.entry != nil && t.writeCachedPage(status, resolved, call.entry) {
+			return
+		}
+		_ = t.renderHTML(status, []string{name}, nil)
+		return
+	}
+
+	var entry []byte
+	defer func() { t.pageCalls.finish(key, call, entry) }()
+
+	w := &recordingResponseWriter{ResponseWriter: t.responseWriter}
+	t.responseWriter = w
+	err = t.renderHTML(status, []string{name}, nil)
+	t.responseWriter = w.ResponseWriter
+	if err != nil || w.Status() != status {
+		return
+	}
+
+	entry = encodePage(w.Header().Get("Content-Type"), w.body.Bytes())
+	t.opts.FragmentCache.Set(key, entry, ttl)
+}
+
+// writeCachedPage writes the cached page of the named template to the response
+// with the status, and returns false if the entry is malformed.
+func (t *template) writeCachedPage(status int, name string, entry []byte) bool {
+	contentType, body, ok := decodePage(entry)
+	if !ok {
+		return false
+	}
+
+	n, err := t.write(status, contentType, bytes.NewBuffer(body), nil)
+	t.afterWrite(name, n, err)
+	return true
+}
+
+// resolveName returns Options.DefaultTemplate if the name is empty.
+func (t *template) resolveName(name string) (string, error) {
+	if name != "" {
+		return normalizeName(*t.opts, name), nil
+	} else if t.opts.DefaultTemplate == "" {
+		return "", errors.New("empty template name without Options.DefaultTemplate")
+	}
+	return normalizeName(*t.opts, t.opts.DefaultTemplate), nil
+}
+
+// normalizeName returns the name in lowercase when
+// Options.CaseInsensitiveNames is enabled.
+func normalizeName(opts Options, name string) string {
+	if opts.CaseInsensitiveNames {
+		return strings.ToLower(name)
+	}
+	return name
 }
 
 func (t *template) responseServerError(w http.ResponseWriter, err error) {
 	t.logger.Error("rendering", "error", err)
+	if t.opts.OnError != nil {
+		t.opts.OnError(err)
+	}
 	if flamego.Env() == flamego.EnvTypeDev {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
@@ -48,37 +335,867 @@ func (t *template) responseServerError(w http.ResponseWriter, err error) {
 	}
 }
 
+// responseMissingTemplate responds with Options.MissingTemplateStatus for the
+// named template that does not exist, and renders Options.MissingTemplate if
+// it is set and exists.
+func (t *template) responseMissingTemplate(name string, headers map[string]string) error {
+	err := errors.Errorf("template %q is undefined", name)
+	t.logger.Warn("Template not found", "name", name)
+
+	status := t.opts.MissingTemplateStatus
+	if status <= 0 {
+		status = http.StatusInternalServerError
+	}
+	if t.opts.MissingTemplate != "" && t.set.has(normalizeName(*t.opts, t.opts.MissingTemplate)) {
+		_ = t.renderHTML(status, []string{t.opts.MissingTemplate}, headers)
+		return err
+	}
+	http.Error(t.responseWriter, http.StatusText(status), status)
+	return err
+}
+
+// renderData returns a shallow copy of the Data to render against, so that
+// internal keys (e.g. "RenderDuration") are never written to the Data of the
+// handler.
+func (t *template) renderData() Data {
+	t.safeData.lock.RLock()
+	defer t.safeData.lock.RUnlock()
+
+	data := make(Data, len(t.Data)+1)
+	for k, v := range t.Data {
+		data[k] = v
+	}
+
+	if t.opts.BindingErrorsFunc != nil && t.c != nil {
+		t.injectBindingErrors(data)
+	}
+
+	for _, key := range t.opts.TrustedKeys {
+		s, ok := data[key].(string)
+		if !ok {
+			continue
+		}
+		t.logger.Warn("Rendering trusted key without escaping", "key", key)
+		data[key] = gotemplate.HTML(s)
+	}
+	return data
+}
+
+// injectBindingErrors adds the errors returned by Options.BindingErrorsFunc and
+// the submitted values of the form to the data.
+func (t *template) injectBindingErrors(data Data) {
+	errs := t.opts.BindingErrorsFunc(t.c)
+	if errs == nil {
+		return
+	}
+	data[t.opts.BindingErrorsKey] = errs
+
+	if _, ok := data["Form"]; ok || t.request == nil {
+		return
+	}
+	// It is a no-op when the form has been parsed by the binding middleware.
+	err := t.request.ParseForm()
+	if err != nil {
+		t.logger.Warn("Failed to parse form", "error", err)
+		return
+	}
+	data["Form"] = t.request.Form
+}
+
+// getBuffer returns a reset buffer from the pool, or a new buffer when
+// Options.DisableBufferPool is set.
+func (t *template) getBuffer() *bytes.Buffer {
+	if t.opts.DisableBufferPool {
+		return new(bytes.Buffer)
+	}
+	return t.bufPool.Get()
+}
+
+// putBuffer resets and returns the buffer to the pool, unless its capacity
+// exceeds Options.MaxBufferSize or Options.DisableBufferPool is set.
+func (t *template) putBuffer(buf *bytes.Buffer) {
+	if t.opts.DisableBufferPool {
+		return
+	}
+
+	buf.Reset()
+	if t.opts.MaxBufferSize > 0 && buf.Cap() > t.opts.MaxBufferSize {
+		return
+	}
+	t.bufPool.Put(buf)
+}
+
+// write writes the status, the content type and the content of the buffer to
+// the response, and returns the number of bytes written. Headers from
+// Options.Headers and then the given headers are set after the content type,
+// thus they take precedence.
+func (t *template) write(status int, contentType string, buf *bytes.Buffer, headers map[string]string) (int64, error) {
+	t.writeHeader(status, contentType, headers)
+
+	n, err := buf.WriteTo(t.responseWriter)
+	if err != nil {
+		t.logger.Error("[template] Failed to write out rendered response", "error", err)
+		if t.opts.OnWriteError != nil {
+			t.opts.OnWriteError(err)
+		}
+		return n, errors.Wrap(err, "write")
+	}
+	return n, nil
+}
+
+// withCharset returns the content type with "; charset=utf-8" appended if it is
+// a textual type without charset specified.
+func withCharset(contentType string) string {
+	if strings.Contains(strings.ToLower(contentType), "charset=") {
+		return contentType
+	}
+
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	textual := strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		mediaType == "application/xml" ||
+		mediaType == "application/json" ||
+		mediaType == "application/javascript"
+	if !textual {
+		return contentType
+	}
+	return contentType + "; charset=utf-8"
+}
+
+// checkStatus returns the status if it is a valid HTTP status code, and logs a
+// warning if it is not a known one. Otherwise, it logs an error and returns 500
+// because net/http panics on invalid status codes.
+func (t *template) checkStatus(status int) int {
+	if status < 100 || status > 999 {
+		t.logger.Error("Invalid status code, using 500 instead", "status", status)
+		return http.StatusInternalServerError
+	} else if http.StatusText(status) == "" {
+		t.logger.Warn("Unknown status code", "status", status)
+	}
+	return status
+}
+
+// writeHeader writes the status, the content type and the headers to the
+// response. The reason phrase of the status line is always the default one of
+// net/http, which cannot be customized via http.ResponseWriter.
+func (t *template) writeHeader(status int, contentType string, headers map[string]string) {
+	status = t.checkStatus(status)
+	t.responseWriter.Header().Set("Content-Type", withCharset(contentType))
+	if t.cspNonce != "" && t.opts.CSPPolicy != "" {
+		t.responseWriter.Header().Set("Content-Security-Policy", strings.ReplaceAll(t.opts.CSPPolicy, "{nonce}", t.cspNonce))
+	}
+	for k, v := range t.opts.Headers {
+		t.responseWriter.Header().Set(k, v)
+	}
+	for k, v := range headers {
+		t.responseWriter.Header().Set(k, v)
+	}
+	t.responseWriter.WriteHeader(status)
+}
+
 func (t *template) HTML(status int, name string) {
-	buf := t.bufPool.Get().(*bytes.Buffer)
+	_ = t.renderHTML(status, []string{name}, nil)
+}
+
+func (t *template) HTMLMany(status int, names ...string) {
+	_ = t.renderHTML(status, names, nil)
+}
+
+func (t *template) HTMLWithHeaders(status int, name string, headers map[string]string) {
+	_ = t.renderHTML(status, []string{name}, headers)
+}
+
+func (t *template) HTMLContext(ctx context.Context, status int, name string) {
+	prev := t.ctx
+	t.ctx = ctx
+	defer func() { t.ctx = prev }()
+	_ = t.renderHTML(status, []string{name}, nil)
+}
+
+func (t *template) HTMLErr(status int, name string) error {
+	return t.renderHTML(status, []string{name}, nil)
+}
+
+func (t *template) HTMLLocalized(status int, name string) {
+	name, err := t.resolveName(name)
+	if err != nil {
+		t.responseServerError(t.responseWriter, err)
+		return
+	}
+
+	var langs []string
+	if t.request != nil {
+		langs = acceptLanguages(t.request.Header.Get("Accept-Language"))
+	}
+	if t.opts.DefaultLanguage != "" {
+		langs = append(langs, t.opts.DefaultLanguage)
+	}
+	for _, lang := range langs {
+		variant := normalizeName(*t.opts, name+"."+lang)
+		if t.set.has(variant) {
+			_ = t.renderHTML(status, []string{variant}, map[string]string{"Content-Language": lang})
+			return
+		}
+	}
+	_ = t.renderHTML(status, []string{name}, nil)
+}
+
+// acceptLanguages returns language tags of the "Accept-Language" header in the
+// order of preference, each followed by its primary subtag if it has a region,
+// e.g. ["zh-CN", "zh", "en"] for "zh-CN,en;q=0.8". The wildcard and tags with
+// zero quality are skipped.
+func acceptLanguages(header string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var parsed []lang
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[len("q="):], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		parsed = append(parsed, lang{tag: tag, q: q})
+	}
+	sort.SliceStable(parsed, func(i, j int) bool { return parsed[i].q > parsed[j].q })
+
+	langs := make([]string, 0, len(parsed))
+	seen := make(map[string]bool, len(parsed))
+	add := func(tag string) {
+		if !seen[tag] {
+			seen[tag] = true
+			langs = append(langs, tag)
+		}
+	}
+	for _, l := range parsed {
+		add(l.tag)
+		if i := strings.Index(l.tag, "-"); i > 0 {
+			add(l.tag[:i])
+		}
+	}
+	return langs
+}
+
+// immutableCacheControl is the "Cache-Control" header of responses that never
+// change, which are cached for a year as recommended by RFC 8246.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+func (t *template) HTMLImmutable(status int, name string) {
+	resolved, err := t.resolveName(name)
+	if err != nil {
+		t.responseServerError(t.responseWriter, err)
+		return
+	}
+
+	if status == http.StatusOK && t.set.has(resolved) && isConditional(t.request) {
+		t.responseWriter.Header().Set("Cache-Control", immutableCacheControl)
+		t.responseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_ = t.renderHTML(status, []string{name}, map[string]string{"Cache-Control": immutableCacheControl})
+}
+
+func (t *template) HTMLScopes(status int, name string, scopes map[string]Data) {
+	prev := t.scopes
+	t.scopes = scopes
+	defer func() { t.scopes = prev }()
+	_ = t.renderHTML(status, []string{name}, nil)
+}
+
+// scopeData returns the data of the named scope that falls back to the data of
+// the request.
+func (t *template) scopeData(name string) Data {
+	data := t.renderData()
+	for k, v := range t.scopes[name] {
+		data[k] = v
+	}
+	return data
+}
+
+func (t *template) OK(name string)       { t.HTML(http.StatusOK, name) }
+func (t *template) Created(name string)  { t.HTML(http.StatusCreated, name) }
+func (t *template) NotFound(name string) { t.HTML(http.StatusNotFound, name) }
+
+func (t *template) Stream(status int, name string, trailers func(header http.Header)) {
+	name, err := t.resolveName(name)
+	if err != nil {
+		t.responseServerError(t.responseWriter, err)
+		return
+	}
+
+	if t.canceled("streaming") {
+		return
+	}
+
+	t.writeHeader(status, t.contentTypeOf(name), nil)
+
+	err = t.execute(t.responseWriter, name, t.renderData())
+	if err != nil {
+		t.logger.Error("[template] Failed to stream rendered response", "name", name, "error", err)
+		return
+	}
+
+	if trailers != nil {
+		trailers(t.responseWriter.Header())
+	}
+}
+
+// TurboStreamAction is a Hotwire Turbo Stream element to be rendered.
+type TurboStreamAction struct {
+	// Action is the action of the stream, e.g. "append", "replace" and "remove".
+	Action string
+	// Target is the ID of the element to apply the action to.
+	Target string
+	// Name is the name of the template to render as the content of the stream.
+	// The content is left empty when the name is empty, e.g. for "remove".
+	Name string
+}
+
+func (t *template) TurboStream(status int, action, target, name string) {
+	t.TurboStreams(status, TurboStreamAction{Action: action, Target: target, Name: name})
+}
+
+func (t *template) TurboStreams(status int, streams ...TurboStreamAction) {
+	buf := t.getBuffer()
+	defer t.putBuffer(buf)
+
+	data := t.renderData()
+	for _, s := range streams {
+		_, _ = fmt.Fprintf(buf, `<turbo-stream action="%s" target="%s"><template>`,
+			gotemplate.HTMLEscapeString(s.Action),
+			gotemplate.HTMLEscapeString(s.Target),
+		)
+		if s.Name != "" {
+			err := t.execute(buf, normalizeName(*t.opts, s.Name), data)
+			if err != nil {
+				t.responseServerError(t.responseWriter, err)
+				return
+			}
+		}
+		buf.WriteString("</template></turbo-stream>")
+	}
+
+	_, _ = t.write(status, "text/vnd.turbo-stream.html", buf, nil)
+}
+
+func (t *template) SSE(event, name string) error {
+	if strings.ContainsAny(event, "\r\n") {
+		return errors.Errorf("invalid event name %q", event)
+	}
+
+	name, err := t.resolveName(name)
+	if err != nil {
+		return err
+	}
+
+	buf := t.getBuffer()
+	defer t.putBuffer(buf)
+
+	err = t.execute(buf, name, t.renderData())
+	if err != nil {
+		return err
+	}
+
+	msg := t.getBuffer()
+	defer t.putBuffer(msg)
+
+	if event != "" {
+		msg.WriteString("event: " + event + "\n")
+	}
+	body := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(buf.String())
+	for _, line := range strings.Split(body, "\n") {
+		msg.WriteString("data: " + line + "\n")
+	}
+	msg.WriteString("\n")
+
+	_, err = msg.WriteTo(t.responseWriter)
+	if err != nil {
+		return errors.Wrap(err, "write")
+	}
+	t.responseWriter.Flush()
+	return nil
+}
+
+// renderHTML renders the named templates in order into a single response with
+// the given status and headers. It returns the error of rendering or writing,
+// which has already been handled.
+func (t *template) renderHTML(status int, names []string, headers map[string]string) error {
+	resolved := make([]string, len(names))
+	for i, name := range names {
+		var err error
+		resolved[i], err = t.resolveName(name)
+		if err != nil {
+			t.responseServerError(t.responseWriter, err)
+			return err
+		}
+	}
+	names = resolved
+
+	// The status is only known after rendering, thus the output must be buffered.
+	fromTemplate := status == StatusFromTemplate
+	t.templateStatus = 0
+
+	if t.opts.MissingTemplateStatus > 0 || t.opts.MissingTemplate != "" {
+		for _, name := range names {
+			if !t.set.has(name) {
+				return t.responseMissingTemplate(name, headers)
+			}
+		}
+	}
+
+	// Caching headers are only set for successful responses, so that errors are
+	// never cached by intermediaries.
+	var lastModified time.Time
+	setCacheHeaders := func() {
+		if t.opts.CacheMaxAge > 0 {
+			t.responseWriter.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(t.opts.CacheMaxAge.Seconds())))
+		}
+		if !lastModified.IsZero() {
+			t.responseWriter.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+		}
+	}
+	if status == http.StatusOK && t.opts.LastModified {
+		if modTime, ok := t.lastModified(names); ok {
+			lastModified = modTime
+			if notModified(t.request, modTime) {
+				setCacheHeaders()
+				t.responseWriter.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+		}
+	}
+
+	if t.canceled("rendering") {
+		return t.context().Err()
+	}
+
+	err := t.acquireRender()
+	if err != nil {
+		if t.context().Err() == nil {
+			t.logger.Warn("Too many concurrent renders", "error", err)
+			http.Error(t.responseWriter, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+		return err
+	}
+	defer t.releaseRender()
+
+	data := t.renderData()
+	if t.set.usesRenderDuration {
+		started := time.Now()
+		data["RenderDuration"] = func() string {
+			return fmt.Sprint(time.Since(started).Nanoseconds()/1e6) + "ms"
+		}
+	}
+
+	contentType := t.contentType
+	if len(names) > 0 {
+		contentType = t.contentTypeOf(names[0])
+	}
+
+	sizeKey := strings.Join(names, ",")
+	if !fromTemplate && t.shouldStream(sizeKey) {
+		setCacheHeaders()
+		return t.streamHTML(status, names, contentType, headers, data, sizeKey)
+	}
+
+	buf := t.getBuffer()
+	timedOut := false
 	defer func() {
+		// The buffer is still being written by the abandoned execution.
+		if !timedOut {
+			t.putBuffer(buf)
+		}
+	}()
+
+	timings := make([]time.Duration, len(names))
+	execute := func() error {
+		for i, name := range names {
+			start := time.Now()
+			err := t.execute(buf, name, data)
+			if err != nil {
+				return err
+			}
+			timings[i] = time.Since(start)
+		}
+		return nil
+	}
+
+	timeout, byDeadline := t.renderTimeout()
+	if timeout > 0 {
+		timedOut, err = executeWithTimeout(execute, timeout)
+		if timedOut && t.set.state != nil {
+			// The clone is still being executed by the abandoned execution.
+			t.set.abandoned = true
+		}
+	} else {
+		err = execute()
+	}
+	if timedOut && byDeadline {
+		// The framework has given up on the request, there is no one to respond to.
+		t.logger.Debug("Request deadline exceeded, abandoned rendering", "name", sizeKey)
+		return context.DeadlineExceeded
+	} else if err != nil {
+		t.responseServerError(t.responseWriter, err)
+		return err
+	}
+	if t.opts.StreamThreshold > 0 {
+		t.renderSizes.Store(sizeKey, buf.Len())
+	}
+	if fromTemplate {
+		status = http.StatusOK
+		if t.templateStatus != 0 {
+			status = t.templateStatus
+		}
+	}
+
+	if len(t.opts.PostProcessors) > 0 {
+		name := strings.Join(names, ",")
+		body := buf.Bytes()
+		for _, process := range t.opts.PostProcessors {
+			var err error
+			body, err = process(name, body)
+			if err != nil {
+				err = errors.Wrapf(err, "post-process %q", name)
+				t.responseServerError(t.responseWriter, err)
+				return err
+			}
+		}
 		buf.Reset()
-		t.bufPool.Put(buf)
+		buf.Write(body)
+	}
+
+	if t.opts.ServerTiming {
+		t.responseWriter.Header().Set("Server-Timing", serverTiming(names, timings))
+	}
+
+	if t.canceled("writing") {
+		return t.context().Err()
+	}
+
+	setCacheHeaders()
+	size := buf.Len()
+	n, err := t.write(status, contentType, buf, headers)
+	t.afterWrite(sizeKey, n, err)
+	if err != nil {
+		return err
+	}
+	t.afterRender(sizeKey, size)
+	return nil
+}
+
+// afterWrite reports the number of bytes of the rendered output of the named
+// templates written to the response to Options.AfterWrite.
+func (t *template) afterWrite(name string, n int64, err error) {
+	if t.opts.AfterWrite != nil {
+		t.opts.AfterWrite(t.c, name, n, err)
+	}
+}
+
+// afterRender logs the size of the rendered output of the named templates and
+// reports it to Options.AfterRender.
+func (t *template) afterRender(name string, size int) {
+	t.logger.Debug("Rendered", "name", name, "bytes", size)
+	if t.opts.AfterRender != nil {
+		t.opts.AfterRender(name, size)
+	}
+}
+
+// shouldStream returns true if the output should be written to the response
+// directly while rendering instead of being buffered, which is when the
+// previous output of the same templates exceeded Options.StreamThreshold.
+// Rendering with Options.PostProcessors or Options.RenderTimeout is always
+// buffered.
+func (t *template) shouldStream(sizeKey string) bool {
+	if t.opts.StreamThreshold <= 0 || len(t.opts.PostProcessors) > 0 || t.opts.RenderTimeout > 0 {
+		return false
+	}
+	size, ok := t.renderSizes.Load(sizeKey)
+	return ok && size.(int) > t.opts.StreamThreshold
+}
+
+// streamHTML renders the named templates directly to the response. The status
+// is written before rendering, thus errors during rendering can only be logged
+// and returned.
+func (t *template) streamHTML(status int, names []string, contentType string, headers map[string]string, data Data, sizeKey string) error {
+	t.writeHeader(status, contentType, headers)
+
+	w := &countingWriter{w: t.responseWriter}
+	defer func() { t.renderSizes.Store(sizeKey, w.n) }()
+	for _, name := range names {
+		err := t.execute(w, name, data)
+		if err != nil {
+			t.logger.Error("[template] Failed to stream rendered response", "name", name, "error", err)
+			t.afterWrite(sizeKey, int64(w.n), err)
+			return err
+		}
+	}
+	t.afterWrite(sizeKey, int64(w.n), nil)
+	t.afterRender(sizeKey, w.n)
+	return nil
+}
+
+// countingWriter is an io.Writer that counts bytes written to the underlying
+// writer.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += n
+	return n, err
+}
+
+// canceled returns true if the request has been canceled, e.g. the client has
+// disconnected, in which case there is no point to continue the given stage.
+func (t *template) canceled(stage string) bool {
+	err := t.context().Err()
+	if err == nil {
+		return false
+	}
+	t.logger.Debug("Request is canceled, skipped "+stage, "error", err)
+	return true
+}
+
+// renderTimeout returns the timeout of rendering, which is the smaller of
+// Options.RenderTimeout and the time left until the deadline of the context,
+// and whether the deadline is the one in effect.
+func (t *template) renderTimeout() (timeout time.Duration, byDeadline bool) {
+	timeout = t.opts.RenderTimeout
+	deadline, ok := t.context().Deadline()
+	if !ok {
+		return timeout, false
+	}
+
+	left := time.Until(deadline)
+	if left <= 0 {
+		// A non-positive timeout means no timeout.
+		left = time.Nanosecond
+	}
+	if timeout <= 0 || left < timeout {
+		return left, true
+	}
+	return timeout, false
+}
+
+// context returns the context of the current rendering, which is the one given
+// to HTMLContext or the context of the request.
+func (t *template) context() context.Context {
+	if t.ctx != nil {
+		return t.ctx
+	}
+	if t.request != nil {
+		return t.request.Context()
+	}
+	return context.Background()
+}
+
+// contentTypeOf returns the content type of the named template.
+func (t *template) contentTypeOf(name string) string {
+	if contentType, ok := t.set.contentTypes[name]; ok {
+		return contentType
+	}
+	return t.contentType
+}
+
+// acquireRender blocks until the number of renders in progress is below
+// Options.MaxConcurrentRenders. It returns an error if Options.RenderQueueTimeout
+// is reached or the request is canceled.
+func (t *template) acquireRender() error {
+	if t.renderSem == nil {
+		return nil
+	}
+
+	var timeout <-chan time.Time
+	if t.opts.RenderQueueTimeout > 0 {
+		timer := time.NewTimer(t.opts.RenderQueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case t.renderSem <- struct{}{}:
+		return nil
+	case <-timeout:
+		return errors.Errorf("no render slot available after %s", t.opts.RenderQueueTimeout)
+	case <-t.context().Done():
+		return t.context().Err()
+	}
+}
+
+// releaseRender releases the render slot acquired by acquireRender.
+func (t *template) releaseRender() {
+	if t.renderSem != nil {
+		<-t.renderSem
+	}
+}
+
+// executeWithTimeout runs the execute function in a goroutine and returns true
+// with an error if it does not finish within the timeout. The goroutine is
+// not stopped and keeps running until the execution finishes.
+func executeWithTimeout(execute func() error, timeout time.Duration) (timedOut bool, err error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- execute()
 	}()
 
-	started := time.Now()
-	t.Data["RenderDuration"] = func() string {
-		return fmt.Sprint(time.Since(started).Nanoseconds()/1e6) + "ms"
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+		return false, err
+	case <-timer.C:
+		return true, errors.Errorf("render timed out after %s", timeout)
+	}
+}
+
+// lastModified returns the newest modification time among the named templates
+// and their dependencies, or false if any of them is unknown.
+func (t *template) lastModified(names []string) (time.Time, bool) {
+	var newest time.Time
+	for _, name := range names {
+		modTime, ok := t.set.modTimes[name]
+		if !ok {
+			return time.Time{}, false
+		} else if modTime.After(newest) {
+			newest = modTime
+		}
+	}
+	return newest, true
+}
+
+// serverTiming returns the value of the "Server-Timing" header for rendering
+// given templates, e.g. `render;dur=1.234`. Each template is reported as a
+// "fragment" metric when there are more than one.
+func serverTiming(names []string, timings []time.Duration) string {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	}
+
+	var total time.Duration
+	for _, d := range timings {
+		total += d
+	}
+
+	metrics := []string{"render;dur=" + ms(total)}
+	if len(names) > 1 {
+		for i, name := range names {
+			metrics = append(metrics, "fragment;desc="+strconv.Quote(name)+";dur="+ms(timings[i]))
+		}
+	}
+	return strings.Join(metrics, ", ")
+}
+
+func (t *template) Text(status int, name string) {
+	t.renderText(status, name, "text/plain")
+}
+
+func (t *template) HTMLRaw(status int, name string) {
+	if !t.opts.AllowHTMLRaw {
+		t.responseServerError(t.responseWriter, errors.New("HTMLRaw requires Options.AllowHTMLRaw"))
+		return
 	}
+	t.renderText(status, name, "")
+}
 
-	err := t.ExecuteTemplate(buf, name, t.Data)
+// renderText renders the named template from the text/template set, which
+// does not escape the output, with the given status and content type. The
+// content type of the template is used when the given one is empty.
+func (t *template) renderText(status int, name, contentType string) {
+	name, err := t.resolveName(name)
 	if err != nil {
 		t.responseServerError(t.responseWriter, err)
 		return
 	}
+	if contentType == "" {
+		contentType = t.contentTypeOf(name)
+	}
 
-	t.responseWriter.Header().Set("Content-Type", t.contentType+"; charset=utf-8")
-	t.responseWriter.WriteHeader(status)
+	tpl, err := t.set.textTemplate()
+	if err != nil {
+		t.responseServerError(t.responseWriter, err)
+		return
+	}
+
+	buf := t.getBuffer()
+	defer t.putBuffer(buf)
+
+	err = tpl.ExecuteTemplate(buf, name, t.renderData())
+	if err != nil {
+		t.responseServerError(t.responseWriter, newRenderError(name, err))
+		return
+	}
+
+	_, _ = t.write(status, contentType, buf, nil)
+}
 
-	_, err = buf.WriteTo(t.responseWriter)
+func (t *template) XML(status int, v interface{}) {
+	buf := t.getBuffer()
+	defer t.putBuffer(buf)
+
+	buf.WriteString(xml.Header)
+	err := xml.NewEncoder(buf).Encode(v)
 	if err != nil {
-		t.logger.Error("[template] Failed to write out rendered HTML", "error", err)
+		t.responseServerError(t.responseWriter, err)
 		return
 	}
+
+	_, _ = t.write(status, "application/xml", buf, nil)
 }
 
 // Data is used as the root object for rendering a template.
+//
+// Like any map, Data is not safe for concurrent use. Use SafeData when it needs
+// to be written from multiple goroutines, e.g. goroutines spawned by a handler.
 type Data map[string]interface{}
 
+// SafeData guards the Data of a request with a mutex, which is safe for
+// concurrent use. Rendering takes a shallow copy of the Data while holding the
+// read lock, thus writes made through SafeData never race with rendering.
+type SafeData struct {
+	lock sync.RWMutex
+	data Data
+}
+
+// Set sets the value of the key.
+func (d *SafeData) Set(key string, value interface{}) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.data[key] = value
+}
+
+// Get returns the value of the key and whether the key exists.
+func (d *SafeData) Get(key string) (interface{}, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	v, ok := d.data[key]
+	return v, ok
+}
+
+// Delete deletes the key.
+func (d *SafeData) Delete(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.data, key)
+}
+
 // Delims is a pair of Left and Right delimiters for rendering HTML templates.
 type Delims struct {
 	// Left is the left delimiter. Default is "{{".
@@ -87,6 +1204,30 @@ type Delims struct {
 	Right string
 }
 
+// splitDelims returns the delimiters declared by the leading
+// `{{/* delims [[ ]] */}}` directive of the template, written with the given
+// delimiters, and the rest of the template with the directive stripped. The
+// given delimiters are returned when there is no such directive.
+func splitDelims(data []byte, delims Delims) (Delims, []byte) {
+	left, right := delims.Left, delims.Right
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+
+	re := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(left) + `-?\s*/\*\s*delims\s+(\S+)\s+(\S+)\s*\*/\s*-?` + regexp.QuoteMeta(right) + `\r?\n?`)
+	m := re.FindSubmatchIndex(data)
+	if m == nil {
+		return delims, data
+	}
+	return Delims{
+		Left:  string(data[m[2]:m[3]]),
+		Right: string(data[m[4]:m[5]]),
+	}, data[m[1]:]
+}
+
 // Options contains options for the template.Templater middleware.
 type Options struct {
 	// FileSystem is the interface for supporting any implementation of the
@@ -98,30 +1239,406 @@ type Options struct {
 	// AppendDirectories is a list of additional directories to load templates for
 	// overwriting templates that are loaded from FileSystem or Directory.
 	AppendDirectories []string
+	// Roots is the map of namespaces to directories of additional template trees,
+	// whose templates are named with the namespace and a colon as the prefix, e.g.
+	// "admin:header" for "header.tmpl" in the directory of namespace "admin".
+	// References between templates (e.g. the "template" action) must use the full
+	// names. Names of other templates are not checked against namespaces by
+	// default, thus a file named "admin:header.tmpl" in the Directory (or a name
+	// with a colon returned by NameFunc) collides with the namespaced template,
+	// which is an error when StrictNames is enabled.
+	Roots map[string]string
 	// Extensions is a list of extensions to be used for template files. Default is
-	// `[".tmpl", ".html"]`.
+	// `[".tmpl", ".html"]`. Extensions are matched as suffixes of file names in
+	// order, and the first match is stripped to derive the template name. For
+	// example, "page.html.tmpl" is named "page" with ".html.tmpl" (or
+	// "*.html.tmpl"), and "page.html" with ".tmpl".
 	Extensions []string
 	// FuncMaps is a list of `template.FuncMap` to be applied for rendering
 	// templates.
 	FuncMaps []gotemplate.FuncMap
+	// WithDefaultFuncs indicates whether to register a set of commonly used
+	// functions, i.e. "upper", "lower", "title", "join", "default", "dict",
+	// "safeHTML" and its alias "safe", "jsonSafe", and pagination functions
+	// "pages", "pageRange", "hasPrev" and "hasNext". Functions from FuncMaps take
+	// precedence over them.
+	WithDefaultFuncs bool
 	// Delims is the pair of left and right delimiters for rendering templates.
+	// A template may override them with a leading `{{/* delims [[ ]] */}}`
+	// directive.
 	Delims Delims
-	// ContentType specifies the value of "Content-Type". Default is "text/html".
+	// DefaultTemplate is the name of the template to render when an empty name
+	// is given, e.g. "index".
+	DefaultTemplate string
+	// MissingKey controls the behavior when a map is indexed with a key that is
+	// not present, which is one of "default", "invalid", "zero" and "error". See
+	// text/template.Template.Option for details. Use "error" to fail rendering on
+	// typos in data keys. Default is "default".
+	MissingKey string
+	// ContentType specifies the value of "Content-Type". When not set, it is
+	// inferred from the extension of the template file using
+	// mime.TypeByExtension (e.g. "application/json" for ".json"), except for
+	// ".tmpl" and ".html" which default to "text/html". When rendering multiple
+	// templates, the first one decides. The "; charset=utf-8" suffix is only
+	// appended to textual types without charset specified.
 	ContentType string
+	// CheckReferences indicates whether to verify at compile time that templates
+	// referenced via the "template" action, or the "include" and "render"
+	// functions are defined, which would otherwise only fail when the branch is
+	// executed.
+	CheckReferences bool
+	// PartialPrefix is the prefix of base names of templates that are partials or
+	// layouts, e.g. "_" for "partials/_footer", which are skipped by
+	// Engine.RenderAll.
+	PartialPrefix string
+	// WarnOnOverride indicates whether to log a warning when a template overrides
+	// another one with the same name, e.g. from AppendDirectories.
+	WarnOnOverride bool
+	// StrictNames indicates whether to return an error when the FileSystem (or
+	// Directory) contains multiple files resolving to the same template name,
+	// e.g. "home.tmpl" and "home.html", or a template name that starts with a
+	// namespace of Roots and a colon. Overriding templates by AppendDirectories is
+	// not considered as a collision.
+	StrictNames bool
+	// AssetManifest is the mapping from logical paths of assets to their
+	// fingerprinted URLs, e.g. "css/app.css" to "/css/app.abc123.css". When set,
+	// the "asset" function is available to templates, e.g.
+	// `{{asset "css/app.css"}}`, which returns the path as-is when it is not in
+	// the manifest.
+	AssetManifest map[string]string
+	// PostProcessors is a list of functions to transform the rendered HTML in
+	// order before writing it to the response, e.g. minifying. The name is the
+	// name of the rendered template, or names joined by commas when rendering
+	// multiple templates.
+	PostProcessors []func(name string, body []byte) ([]byte, error)
+	// StripHTMLComments indicates whether to remove HTML comments from the
+	// rendered HTML after PostProcessors, preserving conditional comments, CDATA
+	// sections and content of elements like <script> and <style>. Note that
+	// html/template already elides comments in the template text, thus this
+	// mostly affects trusted content, e.g. values of template.HTML.
+	StripHTMLComments bool
+	// MaxRenderDepth is the maximum depth of nested calls of the "include" and
+	// "render" functions within a rendering, beyond which the rendering fails
+	// instead of recursing infinitely, e.g. a partial that includes itself. Calls
+	// of both functions count toward the same depth. Default is 100.
+	MaxRenderDepth int
+	// AllowHTMLRaw indicates whether to allow Template.HTMLRaw to render templates
+	// without escaping, which compiles a text/template set on first use in
+	// addition to the html/template set.
+	AllowHTMLRaw bool
+	// OnWriteError is called with the error when writing out the rendered response
+	// fails, e.g. the response is truncated because the client has disconnected.
+	// The error is always logged.
+	OnWriteError func(err error)
+	// OnError is called with the error when rendering fails and the response is
+	// responded with status 500, which is a *RenderError when executing a
+	// template fails. The error is always logged.
+	OnError func(err error)
+	// MissingTemplateStatus is the status to respond with when the template to
+	// render by Template.HTML and alike does not exist, e.g. http.StatusNotFound
+	// for distinguishing routing bugs from broken templates. Default is
+	// http.StatusInternalServerError.
+	MissingTemplateStatus int
+	// MissingTemplate is the name of the template to render with
+	// MissingTemplateStatus when the template to render does not exist, e.g.
+	// "errors/404".
+	MissingTemplate string
+	// AfterRender is called with the name and the size in bytes of the output
+	// after the rendered response of Template.HTML and alike is written, which is
+	// useful for identifying unexpectedly large pages. The name is joined by ","
+	// for multiple templates.
+	AfterRender func(name string, size int)
+	// AfterWrite is called after the rendered response of Template.HTML and alike
+	// is written to the network, with the number of bytes written and the error
+	// of writing if any, which is useful for access logging of rendered pages.
+	// Unlike AfterRender, it is also called when writing fails. The name is
+	// joined by "," for multiple templates.
+	AfterWrite func(c flamego.Context, name string, bytesWritten int64, err error)
+	// Sanitizer is used by the "sanitize" template function to sanitize
+	// untrusted HTML (e.g. with bluemonday), whose output is not escaped
+	// afterwards. The function is only registered when Sanitizer is set.
+	Sanitizer func(string) string
+	// TrustedKeys is a list of top-level keys of the Data whose string values are
+	// known safe HTML, thus are not escaped when rendered. A warning is logged
+	// whenever a trusted key is rendered to make it auditable. Such values must
+	// never contain untrusted content, prefer the "safe" function of
+	// WithDefaultFuncs for case-by-case usage.
+	TrustedKeys []string
+	// FragmentCache is the cache used by Template.CachedFragment. Default is an
+	// in-memory cache created by NewMemoryFragmentCache.
+	FragmentCache FragmentCache
+	// BufferPool is the pool of buffers for rendering templates. Default is a pool
+	// backed by sync.Pool.
+	BufferPool BufferPool
+	// StreamThreshold is the size in bytes of rendered HTML above which the
+	// output is written to the response while rendering instead of being
+	// buffered. The size of the previous output of the same templates is used as
+	// the estimate, thus the first render is always buffered. Errors occurred
+	// during streaming can only be logged because the status has been written.
+	// Default is 0 (always buffer).
+	StreamThreshold int
+	// MaxBufferSize is the maximum capacity in bytes of a render buffer to be
+	// retained in the pool for reuse. Buffers grown beyond it by large renders
+	// are dropped. Default is 0 (unlimited).
+	MaxBufferSize int
+	// DisableBufferPool indicates whether to allocate a new buffer for every
+	// render instead of reusing buffers from BufferPool, which is meant for
+	// diagnosing suspected corruption caused by reusing buffers, e.g. stale data
+	// across requests.
+	DisableBufferPool bool
+	// Headers is a list of headers to be set for every rendered response.
+	Headers map[string]string
+	// InjectRequest indicates whether to make the current *http.Request available
+	// as "Request" in the Data, e.g. `{{.Request.URL.Path}}`.
+	InjectRequest bool
+	// FlashFunc returns the flash of the request, e.g. the session.Flash mapped by
+	// the flamego/session middleware, which is available as "Flash" in the Data
+	// when not nil.
+	FlashFunc func(c flamego.Context) interface{}
+	// DataInitializers is the list of functions to populate the Data of each
+	// request in order, e.g. adding "CurrentUser" from the session. They are
+	// called by the Templater middleware before any later handler, thus values
+	// of the request mapped by earlier middleware are available to them.
+	DataInitializers []func(c flamego.Context, data Data)
+	// BindingErrorsFunc returns the errors recorded by the binding middleware for
+	// the request, e.g. binding.Errors mapped by the flamego/binding middleware.
+	// Because the binding middleware usually runs after the Templater
+	// middleware, it is called when rendering rather than by the Templater
+	// middleware. When it returns non-nil, the errors are available as
+	// BindingErrorsKey in the Data, along with the submitted values of the form
+	// as "Form" (of type url.Values) unless the key is set, for re-rendering the
+	// form with field errors and the input preserved.
+	BindingErrorsFunc func(c flamego.Context) interface{}
+	// BindingErrorsKey is the key of the errors returned by BindingErrorsFunc in
+	// the Data. Default is "Errors".
+	BindingErrorsKey string
+	// CSRFTokenFunc returns the CSRF token of the request, e.g. the token of
+	// csrf.CSRF mapped by the flamego/csrf middleware. When set, the "csrfToken"
+	// and "csrfField" functions are available to templates, the latter renders a
+	// hidden input field carrying the token.
+	CSRFTokenFunc func(c flamego.Context) string
+	// CSRFFieldName is the name of the hidden input field rendered by the
+	// "csrfField" function. Default is "_csrf".
+	CSRFFieldName string
+	// LocalizerFunc returns the function that translates messages for the locale
+	// of the request, which is available to templates as the "T" function, e.g.
+	// `{{T "greeting" .Name}}`.
+	LocalizerFunc func(c flamego.Context) func(key string, args ...interface{}) string
+	// WithContextFunc indicates whether to register the "context" function, which
+	// returns the context.Context of the current rendering, i.e. the one given to
+	// Template.HTMLContext or the context of the request. Functions that need
+	// the context should accept it as the first argument, e.g.
+	// `{{span context "sidebar"}}` calls `func(ctx context.Context, name string)`.
+	WithContextFunc bool
+	// WithURLFuncs indicates whether to register the "baseURL" function, which
+	// returns the scheme and host of the request, e.g. "https://example.com", and
+	// the "absURL" function, which returns the absolute URL of the path, e.g.
+	// `{{absURL "/about"}}`.
+	WithURLFuncs bool
+	// WithStatusFunc indicates whether to register the "status" function, which
+	// sets the status of the response from within the template when it is
+	// rendered by Template.HTML and alike with StatusFromTemplate, e.g.
+	// `{{status 404}}` for an error page. The status is 200 if the function is
+	// not called.
+	WithStatusFunc bool
+	// WithScopeFunc indicates whether to register the "scope" function, which
+	// returns the data of the named scope given to Template.HTMLScopes, e.g.
+	// `{{with scope "sidebar"}}{{.Title}}{{end}}`. The data of a scope falls
+	// back to the data of the request, i.e. keys of the scope take precedence
+	// and other keys are looked up in the data of the request. The data of the
+	// request is returned as-is for an unknown scope.
+	WithScopeFunc bool
+	// TrustedProxies is the list of IP addresses and CIDR ranges of proxies whose
+	// "X-Forwarded-Proto" and "X-Forwarded-Host" headers are honored by the
+	// "baseURL" and "absURL" functions, e.g. "10.0.0.0/8". Forwarded headers are
+	// ignored by default.
+	TrustedProxies []string
+	// CSPNonce indicates whether to generate a cryptographically random nonce for
+	// every request, which is available as "CSPNonce" in the Data, e.g.
+	// `<script nonce="{{.CSPNonce}}">`.
+	CSPNonce bool
+	// CSPPolicy is the value of the "Content-Security-Policy" header to be set
+	// for every rendered response when CSPNonce is enabled, where "{nonce}" is
+	// replaced by the nonce of the request, e.g. "script-src 'nonce-{nonce}'".
+	CSPPolicy string
+	// ServerTiming indicates whether to set the "Server-Timing" header with the
+	// duration of executing templates.
+	ServerTiming bool
+	// RenderTimeout is the maximum duration of rendering HTML templates, after
+	// which the request is responded with 500. Execution of templates is not
+	// cancelable, thus the rendering continues in the background until finished
+	// and its result is discarded. Default is 0 (no timeout). Rendering is also
+	// abandoned without responding once the deadline of the request context, if
+	// any, is exceeded.
+	RenderTimeout time.Duration
+	// MaxConcurrentRenders is the maximum number of HTML renders in progress at
+	// the same time, which bounds the peak memory of buffers under load spikes.
+	// Renders beyond the limit wait for others to finish. The limit is shared by
+	// all handlers of the engine and its clones. Default is 0 (unlimited).
+	MaxConcurrentRenders int
+	// RenderQueueTimeout is the maximum duration of waiting for other renders to
+	// finish when MaxConcurrentRenders is reached, after which the request is
+	// responded with 503. Default is 0 (wait until the request is canceled).
+	RenderQueueTimeout time.Duration
+	// LastModified indicates whether to set the "Last-Modified" header of HTML
+	// responses with status 200 to the newest modification time among the
+	// rendered templates and the templates they depend on, and to respond with
+	// 304 when the "If-Modified-Since" header of the request is not older. It is
+	// meant for mostly static pages as changes of the data are not taken into
+	// account. The header is omitted when any modification time is unknown, e.g.
+	// templates from an embed.FS or added at runtime.
+	LastModified bool
+	// CacheMaxAge sets the "Cache-Control" header of HTML responses to
+	// "max-age=<seconds>" when it is positive.
+	CacheMaxAge time.Duration
+	// NameFunc derives the template name from the path of a template file
+	// relative to its directory (with slashes) and the matched extension, e.g.
+	// to drop a "pages/" prefix. Default is to strip the extension.
+	NameFunc func(relPath, ext string) string
+	// CaseInsensitiveNames indicates whether to normalize names of templates to
+	// lowercase when compiling and looking them up, e.g. "Home" and "home" refer
+	// to the same template, which avoids inconsistencies between case-sensitive
+	// and case-insensitive file systems. It applies to names of template files,
+	// templates added at runtime, the "extends" directive and names given to the
+	// "include" and "render" functions, but not to names of templates defined by
+	// the "define" and "block" actions nor names referenced by the "template"
+	// action, which are resolved by the standard library as-is. Thus, the
+	// "template" action must reference templates by their lowercase names, e.g.
+	// `{{template "header"}}` for "Header.tmpl".
+	CaseInsensitiveNames bool
+	// DefaultLanguage is the language of the template variant that
+	// Template.HTMLLocalized falls back to when none of the languages accepted by
+	// the request has a variant, e.g. "en" for "home.en".
+	DefaultLanguage string
+	// EnvFilter is consulted with the name of each template file to decide
+	// whether to load it, e.g. to only load a debug toolbar in development based
+	// on flamego.Env(). Templates that are filtered out are not parsed at all.
+	EnvFilter func(name string) bool
+	// KeepBOM indicates whether to keep the leading UTF-8 byte order mark of
+	// template files. By default, it is stripped so that it does not appear in
+	// the rendered output.
+	KeepBOM bool
+	// NormalizeLineEndings indicates whether to convert CRLF to LF in template
+	// files, so that the rendered output is consistent across platforms.
+	NormalizeLineEndings bool
+	// AllowEmpty indicates whether to allow the Directory to be missing, which
+	// results in no templates with a warning logged instead of an error.
+	AllowEmpty bool
+	// EagerLoad indicates whether to read template files from Directory while
+	// walking it. By default, the content of each file is read on its first use.
+	EagerLoad bool
+	// ReloadOnChecksum indicates whether to recompile templates outside of
+	// development when the combined checksum of template files on disk has
+	// changed, which is checked at most once per ReloadInterval rather than per
+	// request and works on file systems without reliable change notifications.
+	// Files are only re-read when their modification times or sizes have
+	// changed. Templates from FileSystem are never reloaded.
+	ReloadOnChecksum bool
+	// ReloadInterval is the minimum interval between checks of
+	// ReloadOnChecksum. Default is 5 seconds.
+	ReloadInterval time.Duration
+}
+
+// source is a template to be parsed.
+type source struct {
+	name    string
+	origin  string // The human-readable origin, e.g. the path on disk
+	data    []byte
+	ext     string
+	modTime time.Time // The zero value when unknown
+}
+
+// ParseError is the error of parsing a template.
+type ParseError struct {
+	// Name is the name of the template that failed to parse.
+	Name string
+	// Line is the line number reported by the parser, or 0 if unknown.
+	Line int
+	// Err is the underlying error returned by the parser.
+	Err error
+}
+
+// newParseError returns a ParseError of the named template, with the line
+// number extracted from the error of the parser. The name is matched literally
+// because it may contain colons, e.g. "admin:home" of Roots.
+func newParseError(name string, err error) *ParseError {
+	perr := &ParseError{
+		Name: name,
+		Err:  err,
+	}
+	re := regexp.MustCompile(`^template: ` + regexp.QuoteMeta(name) + `:(\d+):`)
+	if m := re.FindStringSubmatch(err.Error()); m != nil {
+		perr.Line, _ = strconv.Atoi(m[1])
+	}
+	return perr
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse %q: %v", e.Name, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
 }
 
-func newTemplate(allowedExtensions []string, funcMaps []gotemplate.FuncMap, delmis Delims, fs FileSystem, dir string, others ...string) (*gotemplate.Template, error) {
+// RenderError is the error of executing a template.
+type RenderError struct {
+	// Name is the name of the template that failed to execute.
+	Name string
+	// Field is the field path of the action that failed, e.g. ".User.Name", or
+	// empty if unknown.
+	Field string
+	// Err is the underlying error returned by the execution.
+	Err error
+}
+
+var renderErrorFieldRe = regexp.MustCompile(`executing "[^"]*" at <(\.[^>]*)>`)
+
+// newRenderError returns a RenderError of the named template, with the field
+// path extracted from the error of the execution.
+func newRenderError(name string, err error) *RenderError {
+	rerr := &RenderError{
+		Name: name,
+		Err:  err,
+	}
+	if m := renderErrorFieldRe.FindStringSubmatch(err.Error()); m != nil {
+		rerr.Field = m[1]
+	}
+	return rerr
+}
+
+func (e *RenderError) Error() string {
+	return fmt.Sprintf("render %q: %v", e.Name, e.Err)
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// utf8BOM is the byte order mark that some editors prepend to UTF-8 files.
+var utf8BOM = []byte("\xEF\xBB\xBF")
+
+// loadSources loads all templates from the FileSystem (or Directory) with
+// overrides from AppendDirectories applied.
+func loadSources(opts Options, logger *log.Logger) ([]source, error) {
+	fs := opts.FileSystem
 	if fs == nil {
-		var err error
-		fs, err = newFileSystem(dir, allowedExtensions)
-		if err != nil {
-			return nil, errors.Wrapf(err, "new file system")
+		if opts.AllowEmpty && !isDir(opts.Directory) {
+			logger.Warn("Templates directory does not exist", "directory", opts.Directory)
+			fs = &fileSystem{}
+		} else {
+			var err error
+			fs, err = newFileSystem(opts.Directory, opts.Extensions, opts.EagerLoad)
+			if err != nil {
+				return nil, errors.Wrapf(err, "new file system")
+			}
 		}
 	}
 
 	// Directories are composed in the reverse order because later ones overwrites
 	// previous ones. Therefore, we can simply break of the loop once found an
 	// overwritten when looping in the reverse order.
+	others := opts.AppendDirectories
 	dirs := make([]string, 0, len(others))
 	for i := len(others) - 1; i >= 0; i-- {
 		dirs = append(dirs, others[i])
@@ -139,15 +1656,47 @@ func newTemplate(allowedExtensions []string, funcMaps []gotemplate.FuncMap, delm
 		}
 	}
 
-	tpl := gotemplate.New("Flamego.Template").Delims(delmis.Left, delmis.Right)
-	for _, f := range fs.Files() {
-		t := tpl.New(f.Name())
-		for _, funcMap := range funcMaps {
-			t.Funcs(funcMap)
+	files, err := listFiles(fs)
+	if err != nil {
+		return nil, errors.Wrap(err, "list files")
+	} else if len(files) == 0 && opts.AllowEmpty && isDir(opts.Directory) {
+		logger.Warn("No template is found", "directory", opts.Directory)
+	}
+
+	origins := make(map[string]string, len(files)) // The template name to its origin
+	srcs := make([]source, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if opts.NameFunc != nil {
+			name = opts.NameFunc(f.Name()+f.Ext(), f.Ext())
 		}
+		name = normalizeName(opts, name)
+
+		if opts.EnvFilter != nil && !opts.EnvFilter(name) {
+			continue
+		}
+
+		origin := fileSource(f)
+		if opts.StrictNames {
+			if ns, _, ok := strings.Cut(name, namespaceDelimiter); ok {
+				if _, ok := opts.Roots[ns]; ok {
+					return nil, errors.Errorf("template name %q from %q collides with namespace %q", name, origin, ns)
+				}
+			}
+		}
+		if prev, ok := origins[name]; ok {
+			if opts.StrictNames {
+				return nil, errors.Errorf("duplicated template name %q from %q and %q", name, prev, origin)
+			}
+			if opts.WarnOnOverride {
+				logger.Warn("Template is overridden", "name", name, "previous", prev, "current", origin)
+			}
+		}
+		origins[name] = origin
 
 		var err error
 		var data []byte
+		modTime := fileModTime(f)
 
 		// Loop over append directories and break out once found.
 		for _, dir := range dirs {
@@ -160,88 +1709,202 @@ func newTemplate(allowedExtensions []string, funcMaps []gotemplate.FuncMap, delm
 			if err != nil {
 				return nil, errors.Wrap(err, "read")
 			}
+
+			modTime = time.Time{}
+			if fi, err := os.Stat(fpath); err == nil {
+				modTime = fi.ModTime()
+			}
+
+			if opts.WarnOnOverride {
+				logger.Warn("Template is overridden", "name", name, "previous", origin, "current", fpath)
+			}
+			origin = fpath
 			break
 		}
 
 		if len(data) == 0 {
 			data, err = f.Data()
 			if err != nil {
-				return nil, errors.Wrapf(err, "get data of %q", f.Name())
+				return nil, errors.Wrapf(err, "get data of %q", name)
 			}
 		}
 
-		_, err = t.Parse(string(data))
-		if err != nil {
-			return nil, errors.Wrapf(err, "parse %q", f.Name())
-		}
+		srcs = append(srcs,
+			source{
+				name:    name,
+				origin:  origin,
+				data:    normalizeData(opts, data),
+				ext:     f.Ext(),
+				modTime: modTime,
+			},
+		)
 	}
-	return tpl, nil
+
+	rootSrcs, err := loadRoots(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "load roots")
+	}
+	return append(srcs, rootSrcs...), nil
 }
 
-// Templater returns a middleware handler that injects template.Templater and
-// template.Data into the request context, which are used for rendering
-// templates to the ResponseWriter.
-//
-// When running with flamego.EnvTypeDev, if either Directory or
-// AppendDirectories is specified, templates will be recompiled upon every
-// request.
-func Templater(opts ...Options) flamego.Handler {
-	var opt Options
-	if len(opts) > 0 {
-		opt = opts[0]
+// namespaceDelimiter is the delimiter between the namespace and the name of
+// templates loaded from Options.Roots.
+const namespaceDelimiter = ":"
+
+// loadRoots loads templates from each of Options.Roots in the order of
+// namespaces, named with their namespaces as the prefix.
+func loadRoots(opts Options) ([]source, error) {
+	namespaces := make([]string, 0, len(opts.Roots))
+	for ns := range opts.Roots {
+		if ns == "" || strings.Contains(ns, namespaceDelimiter) {
+			return nil, errors.Errorf("invalid namespace %q", ns)
+		}
+		namespaces = append(namespaces, ns)
 	}
+	sort.Strings(namespaces)
 
-	parseOptions := func(opts Options) Options {
-		if opts.Directory == "" {
-			opts.Directory = "templates"
+	var srcs []source
+	for _, ns := range namespaces {
+		fs, err := newFileSystem(opts.Roots[ns], opts.Extensions, opts.EagerLoad)
+		if err != nil {
+			return nil, errors.Wrapf(err, "new file system for %q", ns)
+		}
+		files, err := listFiles(fs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list files for %q", ns)
 		}
 
-		if len(opts.Extensions) == 0 {
-			opts.Extensions = []string{".tmpl", ".html"}
+		for _, f := range files {
+			name := f.Name()
+			if opts.NameFunc != nil {
+				name = opts.NameFunc(f.Name()+f.Ext(), f.Ext())
+			}
+			name = normalizeName(opts, ns+namespaceDelimiter+name)
+
+			if opts.EnvFilter != nil && !opts.EnvFilter(name) {
+				continue
+			}
+
+			data, err := f.Data()
+			if err != nil {
+				return nil, errors.Wrapf(err, "get data of %q", name)
+			}
+			srcs = append(srcs,
+				source{
+					name:    name,
+					origin:  fileSource(f),
+					data:    normalizeData(opts, data),
+					ext:     f.Ext(),
+					modTime: fileModTime(f),
+				},
+			)
 		}
+	}
+	return srcs, nil
+}
+
+// normalizeData returns the data of a template with the BOM stripped and line
+// endings normalized as configured.
+func normalizeData(opts Options, data []byte) []byte {
+	if !opts.KeepBOM {
+		data = bytes.TrimPrefix(data, utf8BOM)
+	}
+	if opts.NormalizeLineEndings {
+		data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	}
+	return data
+}
 
-		if opts.ContentType == "" {
-			opts.ContentType = "text/html"
+// parseTemplate parses sources into an html/template set, later sources
+// overwrite earlier ones with the same name. Templates that extend other
+// templates are skipped, see parseLayouts. Errors of all sources that failed to
+// parse are returned together.
+func parseTemplate(opts Options, srcs []source) (*gotemplate.Template, error) {
+	tpl := gotemplate.New("Flamego.Template").Delims(opts.Delims.Left, opts.Delims.Right)
+	if opts.MissingKey != "" {
+		switch opts.MissingKey {
+		case "default", "invalid", "zero", "error":
+		default:
+			return nil, errors.Errorf("unknown MissingKey %q", opts.MissingKey)
 		}
-		return opts
+		tpl.Option("missingkey=" + opts.MissingKey)
+	}
+	bindInclude(opts, tpl, nil)
+	// Functions are shared by all templates in the set, thus only need to be
+	// added once.
+	for _, funcMap := range funcMaps(opts) {
+		tpl.Funcs(funcMap)
 	}
 
-	opt = parseOptions(opt)
+	var errs multiError
+	for _, src := range srcs {
+		delims, data := splitDelims(src.data, opts.Delims)
+		parent, _ := splitExtends(data, delims)
+		if parent != "" {
+			continue
+		}
 
-	tpl, err := newTemplate(opt.Extensions, opt.FuncMaps, opt.Delims, opt.FileSystem, opt.Directory, opt.AppendDirectories...)
-	if err != nil {
-		panic("template: new template: " + err.Error())
+		t := tpl.New(src.name).Delims(delims.Left, delims.Right)
+		_, err := t.Parse(string(data))
+		if err != nil {
+			errs = append(errs, newParseError(src.name, err))
+		}
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
 	}
+	return tpl, nil
+}
 
-	bufPool := &sync.Pool{
-		New: func() interface{} { return new(bytes.Buffer) },
+// parseTextTemplate is like parseTemplate but parses into a text/template set,
+// which does not escape the output. Layouts are not resolved, templates that
+// extend other templates are parsed with the directive stripped.
+func parseTextTemplate(opts Options, srcs []source) (*texttemplate.Template, error) {
+	tpl := texttemplate.New("Flamego.Template").Delims(opts.Delims.Left, opts.Delims.Right)
+	if opts.MissingKey != "" {
+		tpl.Option("missingkey=" + opts.MissingKey)
+	}
+	bindTextInclude(opts, tpl, nil)
+	for _, funcMap := range funcMaps(opts) {
+		tpl.Funcs(texttemplate.FuncMap(funcMap))
 	}
 
-	return flamego.LoggerInvoker(func(c flamego.Context, logger *log.Logger) {
-		t := &template{
-			responseWriter: c.ResponseWriter(),
-			logger:         logger.WithPrefix("template"),
-			Template:       tpl,
-			Data:           make(Data),
-			contentType:    opt.ContentType,
-			bufPool:        bufPool,
+	var errs multiError
+	for _, src := range srcs {
+		delims, data := splitDelims(src.data, opts.Delims)
+		_, body := splitExtends(data, delims)
+		t := tpl.New(src.name).Delims(delims.Left, delims.Right)
+		_, err := t.Parse(string(body))
+		if err != nil {
+			errs = append(errs, newParseError(src.name, err))
 		}
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
 
-		if flamego.Env() == flamego.EnvTypeDev &&
-			(opt.Directory != "" || len(opt.AppendDirectories) > 0) {
-			tpl, err := newTemplate(opt.Extensions, opt.FuncMaps, opt.Delims, opt.FileSystem, opt.Directory, opt.AppendDirectories...)
-			if err != nil {
-				http.Error(
-					c.ResponseWriter(),
-					fmt.Sprintf("template: %v", err),
-					http.StatusInternalServerError,
-				)
-				return
-			}
-			t.Template = tpl
-		}
+// newTemplate loads and parses all templates into an html/template set.
+func newTemplate(opts Options, logger *log.Logger) (*gotemplate.Template, error) {
+	srcs, err := loadSources(opts, logger)
+	if err != nil {
+		return nil, err
+	}
+	return parseTemplate(opts, srcs)
+}
 
-		c.MapTo(t, (*Template)(nil))
-		c.Map(t.Data)
-	})
+// Templater returns a middleware handler that injects template.Templater,
+// template.Data and *template.SafeData into the request context, which are used
+// for rendering templates to the ResponseWriter.
+//
+// When running with flamego.EnvTypeDev, if either Directory or
+// AppendDirectories is specified, templates will be recompiled upon every
+// request.
+func Templater(opts ...Options) flamego.Handler {
+	e, err := NewEngine(opts...)
+	if err != nil {
+		panic("template: " + err.Error())
+	}
+	return e.Handler()
 }
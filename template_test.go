@@ -6,14 +6,26 @@ package template
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	gotemplate "html/template"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/charmbracelet/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -101,3 +113,2648 @@ func TestTemplate_HTML(t *testing.T) {
 		})
 	}
 }
+
+func TestNewTemplate_Override(t *testing.T) {
+	fs := memoryFileSystem{
+		NewFile("home", []byte(`from tmpl`), ".tmpl"),
+		NewFile("home", []byte(`from html`), ".html"),
+	}
+
+	t.Run("warn on override", func(t *testing.T) {
+		var buf bytes.Buffer
+		tpl, err := newTemplate(
+			Options{
+				FileSystem:     fs,
+				WarnOnOverride: true,
+			},
+			log.New(&buf),
+		)
+		require.Nil(t, err)
+
+		var out bytes.Buffer
+		require.Nil(t, tpl.ExecuteTemplate(&out, "home", nil))
+		assert.Equal(t, "from html", out.String())
+		assert.Contains(t, buf.String(), "home.tmpl")
+		assert.Contains(t, buf.String(), "home.html")
+	})
+
+	t.Run("warn on override by append directories", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := newTemplate(
+			Options{
+				Directory:         "testdata/overwrite/primary",
+				Extensions:        []string{".tmpl"},
+				AppendDirectories: []string{"testdata/overwrite/append"},
+				WarnOnOverride:    true,
+			},
+			log.New(&buf),
+		)
+		require.Nil(t, err)
+		assert.Contains(t, buf.String(), filepath.Join("testdata", "overwrite", "primary", "head.tmpl"))
+		assert.Contains(t, buf.String(), filepath.Join("testdata", "overwrite", "append", "head.tmpl"))
+	})
+
+	t.Run("strict names", func(t *testing.T) {
+		_, err := newTemplate(
+			Options{
+				FileSystem:  fs,
+				StrictNames: true,
+			},
+			log.New(&bytes.Buffer{}),
+		)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), `duplicated template name "home"`)
+	})
+}
+
+func TestTemplate_XML(t *testing.T) {
+	type item struct {
+		XMLName xml.Name `xml:"item"`
+		Title   string   `xml:"title"`
+	}
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(Options{Directory: "testdata/overwrite/primary"}))
+	f.Get("/", func(t Template) {
+		t.XML(http.StatusOK, item{Title: "Flamego & friends"})
+	})
+	f.Get("/invalid", func(t Template) {
+		t.XML(http.StatusOK, make(chan int))
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/xml; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, xml.Header+"<item><title>Flamego &amp; friends</title></item>", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/invalid", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+}
+
+func TestTemplate_Text(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(Options{Directory: "testdata/text"}))
+	f.Get("/", func(t Template, data Data) {
+		data["Name"] = "<Flamego & friends>"
+		t.Text(http.StatusOK, "greeting")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "Hello, <Flamego & friends>!", resp.Body.String())
+}
+
+func TestTemplate_HTMLMany(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(Options{Directory: "testdata/fragments"}))
+	f.Get("/", func(t Template, data Data) {
+		data["Title"] = "Digest"
+		data["Name"] = "Flamego"
+		t.HTMLMany(http.StatusOK, "header", "body")
+	})
+	f.Get("/broken", func(t Template, data Data) {
+		data["Missing"] = 1
+		t.HTMLMany(http.StatusOK, "header", "broken", "body")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<header>Digest</header><main>Hello, Flamego!</main>", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/broken", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.NotContains(t, resp.Body.String(), "<header>")
+}
+
+func TestTemplate_ServerTiming(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory:    "testdata/fragments",
+			ServerTiming: true,
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "body")
+	})
+	f.Get("/many", func(t Template) {
+		t.HTMLMany(http.StatusOK, "header", "body")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Regexp(t, `^render;dur=\d+\.\d{3}$`, resp.Header().Get("Server-Timing"))
+
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/many", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Regexp(t, `^render;dur=\d+\.\d{3}, fragment;desc="header";dur=\d+\.\d{3}, fragment;desc="body";dur=\d+\.\d{3}$`, resp.Header().Get("Server-Timing"))
+}
+
+func TestTemplate_Headers(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+			Headers: map[string]string{
+				"X-Frame-Options": "DENY",
+				"Cache-Control":   "no-cache",
+			},
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "body")
+	})
+	f.Get("/with-headers", func(t Template) {
+		t.HTMLWithHeaders(http.StatusOK, "body", map[string]string{
+			"Cache-Control": "max-age=60",
+			"Link":          "</app.css>; rel=preload; as=style",
+		})
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "DENY", resp.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "no-cache", resp.Header().Get("Cache-Control"))
+
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/with-headers", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "DENY", resp.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "max-age=60", resp.Header().Get("Cache-Control"))
+	assert.Equal(t, "</app.css>; rel=preload; as=style", resp.Header().Get("Link"))
+}
+
+func TestTemplate_CSPNonce(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/csp",
+			CSPNonce:  true,
+			CSPPolicy: "script-src 'nonce-{nonce}'",
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+
+	render := func() (nonce string) {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		policy := resp.Header().Get("Content-Security-Policy")
+		require.True(t, strings.HasPrefix(policy, "script-src 'nonce-"))
+		nonce = strings.TrimSuffix(strings.TrimPrefix(policy, "script-src 'nonce-"), "'")
+		assert.Len(t, nonce, 22)
+		assert.Equal(t, `<script nonce="`+nonce+`"></script>`, resp.Body.String())
+		return nonce
+	}
+
+	assert.NotEqual(t, render(), render())
+}
+
+func TestSafeData(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(Options{Directory: "testdata/fragments"}))
+	f.Get("/", func(tpl Template, data Data, safeData *SafeData) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				safeData.Set(fmt.Sprintf("Key%d", i), i)
+				if i == 0 {
+					safeData.Set("Name", "Flamego")
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		v, ok := safeData.Get("Key9")
+		assert.True(t, ok)
+		assert.Equal(t, 9, v)
+		assert.Equal(t, "Flamego", data["Name"])
+
+		safeData.Delete("Key9")
+		_, ok = safeData.Get("Key9")
+		assert.False(t, ok)
+
+		tpl.HTML(http.StatusOK, "body")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<main>Hello, Flamego!</main>", resp.Body.String())
+}
+
+func TestTemplate_HTML_DataUntouched(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(Options{Directory: "testdata/fragments"}))
+	f.Get("/", func(tpl Template, data Data) {
+		data["Name"] = "Flamego"
+		tpl.HTML(http.StatusOK, "body")
+
+		_, ok := data["RenderDuration"]
+		assert.False(t, ok)
+		assert.Equal(t, Data{"Name": "Flamego"}, data)
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestTemplate_InjectRequest(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory:     "testdata/request",
+			InjectRequest: true,
+		},
+	))
+	f.Get("/search", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/search?q=flamego", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "/search?q=flamego", resp.Body.String())
+}
+
+func TestTemplate_FlashFunc(t *testing.T) {
+	type flash string
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(func(c flamego.Context) {
+		if c.Request().URL.Query().Get("flash") != "" {
+			c.Map(flash(c.Request().URL.Query().Get("flash")))
+		}
+	})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/flash",
+			FlashFunc: func(c flamego.Context) interface{} {
+				v := c.Value(reflect.TypeOf(flash("")))
+				if !v.IsValid() {
+					return nil
+				}
+				return v.Interface()
+			},
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/?flash=Saved", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<div>Saved</div>", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "", resp.Body.String())
+}
+
+func TestTemplate_DataInitializers(t *testing.T) {
+	type user string
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(func(c flamego.Context) {
+		c.Map(user("Joe"))
+	})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+			DataInitializers: []func(c flamego.Context, data Data){
+				func(c flamego.Context, data Data) {
+					data["Title"] = c.Value(reflect.TypeOf(user(""))).Interface()
+				},
+				// Later initializers see values of earlier ones.
+				func(c flamego.Context, data Data) {
+					data["Title"] = fmt.Sprintf("Hello, %s!", data["Title"])
+				},
+			},
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "header")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<header>Hello, Joe!</header>", resp.Body.String())
+}
+
+func TestTemplate_BindingErrors(t *testing.T) {
+	type bindingErrors []string
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/binding",
+			BindingErrorsFunc: func(c flamego.Context) interface{} {
+				v := c.Value(reflect.TypeOf(bindingErrors(nil)))
+				if !v.IsValid() {
+					return nil
+				}
+				return v.Interface()
+			},
+		},
+	))
+	// The binding middleware runs after the Templater middleware.
+	bind := func(c flamego.Context) {
+		if !strings.Contains(c.Request().FormValue("email"), "@") {
+			c.Map(bindingErrors{"Email is invalid"})
+		}
+	}
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "form")
+	})
+	f.Post("/", bind, func(t Template) {
+		t.HTML(http.StatusUnprocessableEntity, "form")
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		wantBody string
+	}{
+		{
+			name:     "no errors",
+			method:   http.MethodGet,
+			wantBody: `<input name="email" value="">`,
+		},
+		{
+			name:     "errors",
+			method:   http.MethodPost,
+			body:     "email=joe%3Cexample",
+			wantBody: `<p>Email is invalid</p><input name="email" value="joe&lt;example">`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(test.method, "/", strings.NewReader(test.body))
+			require.Nil(t, err)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			f.ServeHTTP(resp, req)
+			assert.Equal(t, test.wantBody, resp.Body.String())
+		})
+	}
+}
+
+func TestTemplate_CSRFTokenFunc(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/csrf",
+			CSRFTokenFunc: func(c flamego.Context) string {
+				return c.Request().Header.Get("X-Token")
+			},
+		},
+	))
+	f.Get("/{name}", func(c flamego.Context, t Template) {
+		t.HTML(http.StatusOK, c.Param("name"))
+	})
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{
+			name:  "token",
+			token: "abc",
+			want:  "<p>abc</p>",
+		},
+		{
+			name:  "token",
+			token: "<def>",
+			want:  "<p>&lt;def&gt;</p>",
+		},
+		{
+			name:  "form",
+			token: `"xyz"`,
+			want:  `<html><form><input type="hidden" name="_csrf" value="&#34;xyz&#34;"></form></html>`,
+		},
+	}
+	flamego.SetEnv(flamego.EnvTypeProd)
+	defer flamego.SetEnv(flamego.EnvTypeDev)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/"+test.name, nil)
+			require.Nil(t, err)
+			req.Header.Set("X-Token", test.token)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, test.want, resp.Body.String())
+		})
+	}
+}
+
+func TestTemplate_LocalizerFunc(t *testing.T) {
+	messages := map[string]map[string]string{
+		"en-US": {"greeting": "Hello, %s!"},
+		"zh-CN": {"greeting": "你好，%s！"},
+	}
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/i18n",
+			LocalizerFunc: func(c flamego.Context) func(key string, args ...interface{}) string {
+				locale := c.Request().Header.Get("Accept-Language")
+				return func(key string, args ...interface{}) string {
+					return fmt.Sprintf(messages[locale][key], args...)
+				}
+			},
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Name"] = "Flamego"
+		t.HTML(http.StatusOK, "home")
+	})
+
+	flamego.SetEnv(flamego.EnvTypeProd)
+	defer flamego.SetEnv(flamego.EnvTypeDev)
+
+	for locale, want := range map[string]string{
+		"en-US": "<p>Hello, Flamego!</p>",
+		"zh-CN": "<p>你好，Flamego！</p>",
+	} {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+		req.Header.Set("Accept-Language", locale)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, want, resp.Body.String())
+	}
+}
+
+func TestTemplate_LocalizerFunc_UserDefined(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/i18n",
+			FuncMaps: []gotemplate.FuncMap{
+				{"T": func(key string, _ ...interface{}) string { return "user" }},
+			},
+			LocalizerFunc: func(c flamego.Context) func(key string, args ...interface{}) string {
+				return func(key string, args ...interface{}) string { return "localizer" }
+			},
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<p>user</p>", resp.Body.String())
+}
+
+func TestTemplate_PostProcessors(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+			PostProcessors: []func(name string, body []byte) ([]byte, error){
+				func(name string, body []byte) ([]byte, error) {
+					if name == "broken" {
+						return nil, errors.New("cannot process")
+					}
+					return bytes.ReplaceAll(body, []byte("main>"), []byte("article>")), nil
+				},
+				func(name string, body []byte) ([]byte, error) {
+					return append([]byte("<!-- "+name+" -->"), body...), nil
+				},
+			},
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Name"] = "Flamego"
+		t.HTML(http.StatusOK, "body")
+	})
+	f.Get("/many", func(t Template, data Data) {
+		data["Title"] = "Digest"
+		t.HTMLMany(http.StatusOK, "header", "body")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<!-- body --><article>Hello, Flamego!</article>", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/many", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<!-- header,body --><header>Digest</header><article>Hello, !</article>", resp.Body.String())
+}
+
+// countingBufferPool is a BufferPool that counts buffers created and returned.
+type countingBufferPool struct {
+	created int
+	put     []*bytes.Buffer
+}
+
+func (p *countingBufferPool) Get() *bytes.Buffer {
+	p.created++
+	return new(bytes.Buffer)
+}
+
+func (p *countingBufferPool) Put(buf *bytes.Buffer) {
+	p.put = append(p.put, buf)
+}
+
+func TestTemplate_MaxBufferSize(t *testing.T) {
+	pool := &countingBufferPool{}
+	tpl := &template{
+		opts:    &Options{MaxBufferSize: 64},
+		bufPool: pool,
+	}
+
+	small := tpl.getBuffer()
+	small.WriteString("x")
+	tpl.putBuffer(small)
+	assert.Equal(t, 0, small.Len())
+
+	// The oversized buffer must not be returned to the pool.
+	large := tpl.getBuffer()
+	large.Write(bytes.Repeat([]byte("x"), 128))
+	tpl.putBuffer(large)
+	assert.Equal(t, 0, large.Len())
+
+	assert.Equal(t, 2, pool.created)
+	assert.Equal(t, []*bytes.Buffer{small}, pool.put)
+}
+
+func TestTemplate_BufferPool(t *testing.T) {
+	pool := &countingBufferPool{}
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory:  "testdata/fragments",
+			BufferPool: pool,
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Title"] = "Flamego"
+		t.HTML(http.StatusOK, "header")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<header>Flamego</header>", resp.Body.String())
+	assert.Equal(t, 1, pool.created)
+	assert.Len(t, pool.put, 1)
+}
+
+func TestTemplate_DisableBufferPool(t *testing.T) {
+	pool := &countingBufferPool{}
+	tpl := &template{
+		opts:    &Options{DisableBufferPool: true},
+		bufPool: pool,
+	}
+
+	buf := tpl.getBuffer()
+	buf.WriteString("x")
+	tpl.putBuffer(buf)
+	assert.NotSame(t, buf, tpl.getBuffer())
+
+	assert.Equal(t, 0, pool.created)
+	assert.Empty(t, pool.put)
+}
+
+func TestTemplate_Unwrap(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+		},
+	))
+	f.Get("/", func(tpl Template) {
+		unwrapped := tpl.Unwrap()
+		require.NotNil(t, unwrapped)
+		assert.NotNil(t, unwrapped.Lookup("header"))
+		assert.Nil(t, unwrapped.Lookup("404"))
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestTemplate_MissingKey(t *testing.T) {
+	t.Run("error", func(t *testing.T) {
+		f := flamego.NewWithLogger(&bytes.Buffer{})
+		f.Use(Templater(
+			Options{
+				Directory:  "testdata/fragments",
+				MissingKey: "error",
+			},
+		))
+		f.Get("/", func(t Template, data Data) {
+			data["Name"] = "Flamego"
+			t.HTML(http.StatusOK, "body")
+		})
+		f.Get("/missing", func(t Template) {
+			t.HTML(http.StatusOK, "body")
+		})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "<main>Hello, Flamego!</main>", resp.Body.String())
+
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest(http.MethodGet, "/missing", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Contains(t, resp.Body.String(), `map has no entry for key "Name"`)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := NewEngine(
+			Options{
+				Directory:  "testdata/fragments",
+				MissingKey: "panic",
+			},
+		)
+		assert.Equal(t, `new template: unknown MissingKey "panic"`, err.Error())
+	})
+}
+
+func TestSplitDelims(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		delims     Delims
+		wantDelims Delims
+		wantBody   string
+	}{
+		{
+			name:     "no directive",
+			data:     `<p>{{.Name}}</p>`,
+			wantBody: `<p>{{.Name}}</p>`,
+		},
+		{
+			name:       "directive",
+			data:       "{{/* delims [[ ]] */}}\n<p>[[.Name]]</p>",
+			wantDelims: Delims{Left: "[[", Right: "]]"},
+			wantBody:   `<p>[[.Name]]</p>`,
+		},
+		{
+			name:       "trim markers",
+			data:       "{{- /* delims <% %> */ -}}<p><%.Name%></p>",
+			wantDelims: Delims{Left: "<%", Right: "%>"},
+			wantBody:   `<p><%.Name%></p>`,
+		},
+		{
+			name:       "custom delimiters",
+			data:       "[[/* delims {{ }} */]]\n<p>{{.Name}}</p>",
+			delims:     Delims{Left: "[[", Right: "]]"},
+			wantDelims: Delims{Left: "{{", Right: "}}"},
+			wantBody:   `<p>{{.Name}}</p>`,
+		},
+		{
+			name:     "not leading",
+			data:     `<p></p>{{/* delims [[ ]] */}}`,
+			wantBody: `<p></p>{{/* delims [[ ]] */}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delims, body := splitDelims([]byte(test.data), test.delims)
+			assert.Equal(t, test.wantDelims, delims)
+			assert.Equal(t, test.wantBody, string(body))
+		})
+	}
+}
+
+func TestTemplate_HTML_DelimsDirective(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/delims",
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Name"] = "Flamego"
+		t.HTML(http.StatusOK, "vue")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `<div id="app">{{ message }} by Flamego</div><footer>Flamego</footer>`, resp.Body.String())
+}
+
+func TestTemplate_Execute(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+		},
+	))
+	f.Get("/", func(tpl Template, data Data) {
+		data["Name"] = "Request"
+
+		var buf bytes.Buffer
+		err := tpl.Execute(&buf, "body", Data{"Name": "Flamego"})
+		require.Nil(t, err)
+		assert.Equal(t, "<main>Hello, Flamego!</main>", buf.String())
+
+		buf.Reset()
+		err = tpl.Execute(&buf, "body", nil)
+		require.Nil(t, err)
+		assert.Equal(t, "<main>Hello, Request!</main>", buf.String())
+
+		err = tpl.Execute(&buf, "404", nil)
+		assert.NotNil(t, err)
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Body.String())
+	assert.Empty(t, resp.Header().Get("Content-Type"))
+}
+
+func TestTemplate_RenderTyped(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+		},
+	))
+	f.Get("/", func(tpl Template, data Data) {
+		data["Name"] = "<Request>"
+
+		body, err := tpl.RenderTyped("body", Data{"Name": "<Flamego>"})
+		require.Nil(t, err)
+		assert.Equal(t, gotemplate.HTML("<main>Hello, &lt;Flamego&gt;!</main>"), body)
+
+		body, err = tpl.RenderTyped("body", nil)
+		require.Nil(t, err)
+		assert.Equal(t, gotemplate.HTML("<main>Hello, &lt;Request&gt;!</main>"), body)
+
+		_, err = tpl.RenderTyped("404", nil)
+		assert.NotNil(t, err)
+
+		// The typed output is not escaped again when composed.
+		data["Title"] = body
+		tpl.HTML(http.StatusOK, "header")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<header><main>Hello, &lt;Request&gt;!</main></header>", resp.Body.String())
+}
+
+func TestTemplate_Stream(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/stream",
+		},
+	))
+	f.Get("/", func(c flamego.Context, t Template, data Data) {
+		rows := []int{1, 2, 3}
+		data["Rows"] = rows
+
+		c.ResponseWriter().Header().Set("Trailer", "X-Row-Count")
+		t.Stream(http.StatusOK, "report", func(header http.Header) {
+			header.Set("X-Row-Count", strconv.Itoa(len(rows)))
+		})
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	result := resp.Result()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", result.Header.Get("Content-Type"))
+	assert.Equal(t, "1,2,3,", resp.Body.String())
+	assert.Equal(t, "3", result.Trailer.Get("X-Row-Count"))
+}
+
+func TestTemplate_RenderTimeout(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/timeout",
+			FuncMaps: []gotemplate.FuncMap{
+				{
+					"sleep": func(d time.Duration) string {
+						time.Sleep(d)
+						return "done"
+					},
+				},
+			},
+			RenderTimeout: 50 * time.Millisecond,
+		},
+	))
+	f.Get("/fast", func(t Template, data Data) {
+		data["Duration"] = time.Duration(0)
+		t.HTML(http.StatusOK, "sleep")
+	})
+	f.Get("/slow", func(t Template, data Data) {
+		data["Duration"] = time.Second
+		t.HTML(http.StatusOK, "sleep")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/fast", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<p>done</p>", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/slow", nil)
+	require.Nil(t, err)
+
+	start := time.Now()
+	f.ServeHTTP(resp, req)
+
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Equal(t, "render timed out after 50ms\n", resp.Body.String())
+}
+
+func TestTemplate_InferContentType(t *testing.T) {
+	tests := []struct {
+		name            string
+		contentType     string
+		template        string
+		wantContentType string
+	}{
+		{
+			name:            "inferred",
+			template:        "data",
+			wantContentType: "application/json; charset=utf-8",
+		},
+		{
+			name:            "default",
+			template:        "page",
+			wantContentType: "text/html; charset=utf-8",
+		},
+		{
+			name:            "explicit",
+			contentType:     "text/plain",
+			template:        "data",
+			wantContentType: "text/plain; charset=utf-8",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					Directory:   "testdata/mime",
+					Extensions:  []string{".tmpl", ".json"},
+					ContentType: test.contentType,
+				},
+			))
+			f.Get("/", func(t Template, data Data) {
+				data["Name"] = "Flamego"
+				t.HTML(http.StatusOK, test.template)
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, test.wantContentType, resp.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestWithCharset(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{contentType: "text/html", want: "text/html; charset=utf-8"},
+		{contentType: "application/json", want: "application/json; charset=utf-8"},
+		{contentType: "application/atom+xml", want: "application/atom+xml; charset=utf-8"},
+		{contentType: "text/plain; charset=iso-8859-1", want: "text/plain; charset=iso-8859-1"},
+		{contentType: "application/octet-stream", want: "application/octet-stream"},
+		{contentType: "image/svg", want: "image/svg"},
+	}
+	for _, test := range tests {
+		t.Run(test.contentType, func(t *testing.T) {
+			assert.Equal(t, test.want, withCharset(test.contentType))
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		wantErr  string
+		wantName string
+		wantLine int
+	}{
+		{
+			name:     "directory",
+			opts:     Options{Directory: "testdata/broken"},
+			wantErr:  `new template: parse "home": template: home:2: unexpected {{end}}`,
+			wantName: "home",
+			wantLine: 2,
+		},
+		{
+			name:     "roots",
+			opts:     Options{Directory: "testdata/fragments", Roots: map[string]string{"admin": "testdata/broken_roots"}},
+			wantErr:  `new template: parse "admin:bad": template: admin:bad:2: unexpected {{end}}`,
+			wantName: "admin:bad",
+			wantLine: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewEngine(test.opts)
+			require.NotNil(t, err)
+			assert.Equal(t, test.wantErr, err.Error())
+
+			var perr *ParseError
+			require.True(t, errors.As(err, &perr))
+			assert.Equal(t, test.wantName, perr.Name)
+			assert.Equal(t, test.wantLine, perr.Line)
+		})
+	}
+}
+
+func TestParseError_Aggregated(t *testing.T) {
+	_, err := NewEngine(
+		Options{
+			Directory: "testdata/broken_many",
+		},
+	)
+	require.NotNil(t, err)
+
+	msg := err.Error()
+	assert.Contains(t, msg, `parse "about": template: about:1:`)
+	assert.Contains(t, msg, `parse "home": template: home:2: unexpected {{end}}`)
+	assert.NotContains(t, msg, `"valid"`)
+
+	var perr *ParseError
+	require.True(t, errors.As(err, &perr))
+	assert.Contains(t, []string{"about", "home"}, perr.Name)
+}
+
+func TestTemplate_DefaultTemplate(t *testing.T) {
+	tests := []struct {
+		name            string
+		defaultTemplate string
+		wantCode        int
+		wantBody        string
+	}{
+		{
+			name:            "configured",
+			defaultTemplate: "header",
+			wantCode:        http.StatusOK,
+			wantBody:        "<header>Flamego</header>",
+		},
+		{
+			name:     "not configured",
+			wantCode: http.StatusInternalServerError,
+			wantBody: "empty template name without Options.DefaultTemplate\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					Directory:       "testdata/fragments",
+					DefaultTemplate: test.defaultTemplate,
+				},
+			))
+			f.Get("/", func(t Template, data Data) {
+				data["Title"] = "Flamego"
+				t.HTML(http.StatusOK, "")
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			assert.Equal(t, test.wantBody, resp.Body.String())
+		})
+	}
+}
+
+func TestTemplate_AllowEmpty(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+
+	_, err := NewEngine(Options{Directory: dir})
+	assert.NotNil(t, err)
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory:  dir,
+			AllowEmpty: true,
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"home" is undefined`)
+}
+
+func TestTemplate_HTML_Canceled(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "header")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Empty(t, resp.Body.String())
+	assert.Empty(t, resp.Header().Get("Content-Type"))
+}
+
+func TestTemplate_HTML_Deadline(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		wantCalled bool
+	}{
+		{
+			name:       "expired before rendering",
+			timeout:    -time.Second,
+			wantCalled: false,
+		},
+		{
+			name:       "expired while rendering",
+			timeout:    20 * time.Millisecond,
+			wantCalled: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+
+			var called int32
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					Directory: "testdata/concurrency",
+					FuncMaps: []gotemplate.FuncMap{
+						{
+							"wait": func() string {
+								atomic.StoreInt32(&called, 1)
+								<-release
+								return "done"
+							},
+						},
+					},
+				},
+			))
+			f.Get("/", func(tpl Template) {
+				err := tpl.HTMLErr(http.StatusOK, "home")
+				assert.True(t, errors.Is(err, context.DeadlineExceeded))
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCalled, atomic.LoadInt32(&called) == 1)
+			assert.Empty(t, resp.Body.String())
+			assert.Empty(t, resp.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestTemplate_HTMLContext(t *testing.T) {
+	type userKey struct{}
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/context",
+			FuncMaps: []gotemplate.FuncMap{
+				{
+					"user": func(ctx context.Context) string {
+						user, _ := ctx.Value(userKey{}).(string)
+						return user
+					},
+				},
+			},
+			WithContextFunc: true,
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+	f.Get("/context", func(t Template) {
+		t.HTMLContext(context.WithValue(context.Background(), userKey{}, "alice"), http.StatusOK, "home")
+	})
+	f.Get("/canceled", func(t Template) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.HTMLContext(ctx, http.StatusOK, "home")
+	})
+
+	flamego.SetEnv(flamego.EnvTypeProd)
+	defer flamego.SetEnv(flamego.EnvTypeDev)
+
+	tests := []struct {
+		name string
+		url  string
+		ctx  context.Context
+		want string
+	}{
+		{
+			name: "request context",
+			url:  "/",
+			ctx:  context.WithValue(context.Background(), userKey{}, "bob"),
+			want: "<p>bob</p>",
+		},
+		{
+			name: "explicit context",
+			url:  "/context",
+			ctx:  context.WithValue(context.Background(), userKey{}, "bob"),
+			want: "<p>alice</p>",
+		},
+		{
+			name: "canceled context",
+			url:  "/canceled",
+			ctx:  context.Background(),
+			want: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(test.ctx, http.MethodGet, test.url, nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.want, resp.Body.String())
+		})
+	}
+}
+
+// failingResponseWriter is an http.ResponseWriter that always fails to write.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingResponseWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestTemplate_HTMLErr(t *testing.T) {
+	var writeErr error
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+			OnWriteError: func(err error) {
+				writeErr = err
+			},
+		},
+	))
+
+	var gotErr error
+	f.Get("/{name}", func(c flamego.Context, tpl Template, data Data) {
+		data["Title"] = "Flamego"
+		gotErr = tpl.HTMLErr(http.StatusOK, c.Param("name"))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		writeErr, gotErr = nil, nil
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/header", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.Nil(t, gotErr)
+		assert.Nil(t, writeErr)
+		assert.Equal(t, "<header>Flamego</header>", resp.Body.String())
+	})
+
+	t.Run("render error", func(t *testing.T) {
+		writeErr, gotErr = nil, nil
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/404", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		assert.NotNil(t, gotErr)
+		assert.Nil(t, writeErr)
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		writeErr, gotErr = nil, nil
+		resp := failingResponseWriter{httptest.NewRecorder()}
+		req, err := http.NewRequest(http.MethodGet, "/header", nil)
+		require.Nil(t, err)
+
+		f.ServeHTTP(resp, req)
+
+		require.NotNil(t, gotErr)
+		assert.Equal(t, "write: connection reset", gotErr.Error())
+		require.NotNil(t, writeErr)
+		assert.Equal(t, "connection reset", writeErr.Error())
+	})
+}
+
+func TestTemplate_TurboStream(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Title"] = "Flamego"
+		t.TurboStream(http.StatusOK, "replace", "header", "header")
+	})
+	f.Get("/many", func(t Template, data Data) {
+		data["Title"] = "Flamego"
+		data["Name"] = "Turbo"
+		t.TurboStreams(http.StatusOK,
+			TurboStreamAction{Action: "append", Target: `"messages"`, Name: "body"},
+			TurboStreamAction{Action: "remove", Target: "notice"},
+		)
+	})
+	f.Get("/missing", func(t Template) {
+		t.TurboStream(http.StatusOK, "append", "footer", "404")
+	})
+
+	tests := []struct {
+		name            string
+		url             string
+		wantCode        int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "single",
+			url:             "/",
+			wantCode:        http.StatusOK,
+			wantContentType: "text/vnd.turbo-stream.html; charset=utf-8",
+			wantBody:        `<turbo-stream action="replace" target="header"><template><header>Flamego</header></template></turbo-stream>`,
+		},
+		{
+			name:            "many",
+			url:             "/many",
+			wantCode:        http.StatusOK,
+			wantContentType: "text/vnd.turbo-stream.html; charset=utf-8",
+			wantBody: `<turbo-stream action="append" target="&#34;messages&#34;"><template><main>Hello, Turbo!</main></template></turbo-stream>` +
+				`<turbo-stream action="remove" target="notice"><template></template></turbo-stream>`,
+		},
+		{
+			name:            "missing",
+			url:             "/missing",
+			wantCode:        http.StatusInternalServerError,
+			wantContentType: "text/plain; charset=utf-8",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			assert.Equal(t, test.wantContentType, resp.Header().Get("Content-Type"))
+			if test.wantBody != "" {
+				assert.Equal(t, test.wantBody, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestTemplate_SSE(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/stream",
+		},
+	))
+	f.Get("/", func(c flamego.Context, tpl Template, data Data) {
+		c.ResponseWriter().Header().Set("Content-Type", "text/event-stream")
+		c.ResponseWriter().WriteHeader(http.StatusOK)
+
+		data["Name"] = "Flamego"
+		data["Title"] = "Events"
+		require.Nil(t, tpl.SSE("update", "item"))
+
+		data["Rows"] = []int{1}
+		require.Nil(t, tpl.SSE("", "report"))
+
+		assert.NotNil(t, tpl.SSE("bad\nevent", "item"))
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.True(t, resp.Flushed)
+	assert.Equal(t, "text/event-stream", resp.Header().Get("Content-Type"))
+	want := "event: update\ndata: <li>Flamego</li>\ndata: <li>Events</li>\n\n" +
+		"data: 1,\n\n"
+	assert.Equal(t, want, resp.Body.String())
+}
+
+func TestTemplate_StripBOM(t *testing.T) {
+	tests := []struct {
+		name    string
+		keepBOM bool
+		want    string
+	}{
+		{
+			name: "strip",
+			want: "<!DOCTYPE html><p>Flamego</p>",
+		},
+		{
+			name:    "keep",
+			keepBOM: true,
+			want:    "\xEF\xBB\xBF<!DOCTYPE html><p>Flamego</p>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := RenderForTest(
+				Options{
+					Directory: "testdata/bom",
+					KeepBOM:   test.keepBOM,
+				},
+				"home",
+				Data{"Name": "Flamego"},
+			)
+			require.Nil(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestTemplate_NormalizeLineEndings(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "home.tmpl"), []byte("<p>\r\n  {{.Name}}\r\n</p>\r\n"), 0644))
+
+	tests := []struct {
+		name      string
+		normalize bool
+		want      string
+	}{
+		{
+			name: "untouched",
+			want: "<p>\r\n  Flamego\r\n</p>\r\n",
+		},
+		{
+			name:      "normalized",
+			normalize: true,
+			want:      "<p>\n  Flamego\n</p>\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := RenderForTest(
+				Options{
+					Directory:            dir,
+					NormalizeLineEndings: test.normalize,
+				},
+				"home",
+				Data{"Name": "Flamego"},
+			)
+			require.Nil(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestTemplate_EnvFilter(t *testing.T) {
+	e, err := NewEngine(
+		Options{
+			Directory: "testdata/fragments",
+			EnvFilter: func(name string) bool {
+				return name != "broken"
+			},
+		},
+	)
+	require.Nil(t, err)
+
+	count, _ := e.Stats()
+	assert.Equal(t, 2, count)
+	assert.Nil(t, e.template().Lookup("broken"))
+	assert.NotNil(t, e.template().Lookup("header"))
+}
+
+func TestTemplate_HTML_Status(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		wantCode int
+		wantLog  string
+	}{
+		{
+			name:     "known",
+			status:   http.StatusCreated,
+			wantCode: http.StatusCreated,
+		},
+		{
+			name:     "unknown",
+			status:   299,
+			wantCode: 299,
+			wantLog:  "Unknown status code",
+		},
+		{
+			name:     "invalid",
+			status:   42,
+			wantCode: http.StatusInternalServerError,
+			wantLog:  "Invalid status code",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			f := flamego.NewWithLogger(&logs)
+			f.Use(Templater(
+				Options{
+					Directory: "testdata/fragments",
+				},
+			))
+			f.Get("/", func(t Template) {
+				t.HTML(test.status, "header")
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			if test.wantLog != "" {
+				assert.Contains(t, logs.String(), test.wantLog)
+			}
+		})
+	}
+}
+
+func TestTemplate_Redirect(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantCode     int
+		wantLocation string
+	}{
+		{
+			name:         "found",
+			status:       http.StatusFound,
+			wantCode:     http.StatusFound,
+			wantLocation: "/login",
+		},
+		{
+			name:         "see other",
+			status:       http.StatusSeeOther,
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/login",
+		},
+		{
+			name:     "not a redirect",
+			status:   http.StatusOK,
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					Directory: "testdata/fragments",
+				},
+			))
+			f.Get("/", func(t Template) {
+				t.Redirect(test.status, "/login")
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			assert.Equal(t, test.wantLocation, resp.Header().Get("Location"))
+		})
+	}
+}
+
+func TestTemplate_HTML_RenderDuration(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(Options{Directory: "testdata/duration"}))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Regexp(t, `^<p>\d+ms</p>$`, resp.Body.String())
+}
+
+func BenchmarkHTML(b *testing.B) {
+	var large strings.Builder
+	large.WriteString(`<ul>{{range .Items}}<li>{{.}}</li>{{end}}</ul>`)
+	for i := 0; i < 100; i++ {
+		large.WriteString(`<p>Lorem ipsum dolor sit amet, {{.Name}}.</p>`)
+	}
+	items := make([]int, 1000)
+	for i := range items {
+		items[i] = i
+	}
+
+	benchmarks := []struct {
+		name     string
+		template string
+	}{
+		{name: "small", template: `<p>Hello, {{.Name}}!</p>`},
+		{name: "large", template: large.String()},
+	}
+
+	// Avoid recompiling templates on every request in development.
+	flamego.SetEnv(flamego.EnvTypeProd)
+	defer flamego.SetEnv(flamego.EnvTypeDev)
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					FileSystem: &memoryFileSystem{NewFile("home", []byte(bm.template), ".tmpl")},
+				},
+			))
+			f.Get("/", func(t Template, data Data) {
+				data["Name"] = "Flamego"
+				data["Items"] = items
+				t.HTML(http.StatusOK, "home")
+			})
+
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func TestTemplate_TrustedKeys(t *testing.T) {
+	var logs bytes.Buffer
+	f := flamego.NewWithLogger(&logs)
+	f.Use(Templater(
+		Options{
+			Directory:   "testdata/fragments",
+			TrustedKeys: []string{"Name"},
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Name"] = "<b>Flamego</b>"
+		data["Title"] = "<b>Untrusted</b>"
+		t.HTMLMany(http.StatusOK, "header", "body")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<header>&lt;b&gt;Untrusted&lt;/b&gt;</header><main>Hello, <b>Flamego</b>!</main>", resp.Body.String())
+	assert.Contains(t, logs.String(), "Rendering trusted key without escaping")
+}
+
+func TestTemplate_NameFunc(t *testing.T) {
+	e, err := NewEngine(
+		Options{
+			Directory: "testdata/basic",
+			FuncMaps: []gotemplate.FuncMap{
+				{"Year": func() int { return 2021 }},
+			},
+			NameFunc: func(relPath, ext string) string {
+				return strings.ToUpper(strings.TrimSuffix(relPath, ext))
+			},
+		},
+	)
+	require.Nil(t, err)
+
+	assert.NotNil(t, e.template().Lookup("HOME"))
+	assert.NotNil(t, e.template().Lookup("BASE/HEAD"))
+	assert.Nil(t, e.template().Lookup("home"))
+}
+
+func TestTemplate_HTMLRaw(t *testing.T) {
+	tests := []struct {
+		name     string
+		allow    bool
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "allowed",
+			allow:    true,
+			wantCode: http.StatusOK,
+			wantBody: "<main>Hello, <b>Flamego</b>!</main>",
+		},
+		{
+			name:     "not allowed",
+			wantCode: http.StatusInternalServerError,
+			wantBody: "HTMLRaw requires Options.AllowHTMLRaw\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					Directory:    "testdata/fragments",
+					AllowHTMLRaw: test.allow,
+				},
+			))
+			f.Get("/", func(t Template, data Data) {
+				data["Name"] = "<b>Flamego</b>"
+				t.HTMLRaw(http.StatusOK, "body")
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			assert.Equal(t, test.wantBody, resp.Body.String())
+			if test.allow {
+				assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestTemplate_HTMLRaw_ContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{name: "exact", template: "data"},
+		{name: "case-insensitive", template: "DATA"},
+		{name: "default", template: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					Directory:            "testdata/mime",
+					Extensions:           []string{".tmpl", ".json"},
+					AllowHTMLRaw:         true,
+					CaseInsensitiveNames: true,
+					DefaultTemplate:      "data",
+				},
+			))
+			f.Get("/", func(t Template, data Data) {
+				data["Name"] = "Flamego"
+				t.HTMLRaw(http.StatusOK, test.template)
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestTemplate_StreamThreshold(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/threshold",
+			FuncMaps: []gotemplate.FuncMap{
+				{"fail": func() (string, error) { return "", errors.New("failed") }},
+			},
+			StreamThreshold: 10,
+		},
+	))
+	f.Get("/", func(c flamego.Context, t Template, data Data) {
+		data["Name"] = "Flamego"
+		data["Fail"] = c.Query("fail") == "true"
+		t.HTML(http.StatusOK, "large")
+	})
+
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "buffered on first render",
+			url:      "/?fail=true",
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "buffered without size estimate",
+			url:      "/",
+			wantCode: http.StatusOK,
+			wantBody: "<p>Flamego</p>",
+		},
+		{
+			// The status has been written before the error occurs.
+			name:     "streamed above threshold",
+			url:      "/?fail=true",
+			wantCode: http.StatusOK,
+			wantBody: "<p>Flamego</p>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			if test.wantBody != "" {
+				assert.Equal(t, test.wantBody, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestTemplate_AfterRender(t *testing.T) {
+	type render struct {
+		name string
+		size int
+	}
+	var renders []render
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+			AfterRender: func(name string, size int) {
+				renders = append(renders, render{name: name, size: size})
+			},
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Title"] = "Flamego"
+		data["Name"] = "Joe"
+		t.HTML(http.StatusOK, "header")
+		t.HTMLMany(http.StatusOK, "header", "body")
+		t.HTML(http.StatusOK, "404")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	want := []render{
+		{name: "header", size: len("<header>Flamego</header>")},
+		{name: "header,body", size: len("<header>Flamego</header><main>Hello, Joe!</main>")},
+	}
+	assert.Equal(t, want, renders)
+}
+
+func TestTemplate_AfterWrite(t *testing.T) {
+	type write struct {
+		path  string
+		name  string
+		bytes int64
+		err   string
+	}
+	var writes []write
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+			AfterWrite: func(c flamego.Context, name string, bytesWritten int64, err error) {
+				w := write{path: c.Request().URL.Path, name: name, bytes: bytesWritten}
+				if err != nil {
+					w.err = err.Error()
+				}
+				writes = append(writes, w)
+			},
+		},
+	))
+	f.Get("/{name}", func(c flamego.Context, t Template, data Data) {
+		data["Title"] = "Flamego"
+		t.HTML(http.StatusOK, c.Param("name"))
+	})
+
+	for _, resp := range []http.ResponseWriter{
+		httptest.NewRecorder(),
+		failingResponseWriter{httptest.NewRecorder()},
+	} {
+		req, err := http.NewRequest(http.MethodGet, "/header", nil)
+		require.Nil(t, err)
+		f.ServeHTTP(resp, req)
+	}
+
+	// Nothing is written when rendering fails.
+	req, err := http.NewRequest(http.MethodGet, "/404", nil)
+	require.Nil(t, err)
+	f.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := []write{
+		{path: "/header", name: "header", bytes: int64(len("<header>Flamego</header>"))},
+		{path: "/header", name: "header", bytes: 0, err: "write: connection reset"},
+	}
+	assert.Equal(t, want, writes)
+}
+
+func TestTemplate_StatusShorthands(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+		},
+	))
+	f.Get("/ok", func(t Template, data Data) {
+		data["Title"] = "OK"
+		t.OK("header")
+	})
+	f.Get("/created", func(t Template, data Data) {
+		data["Title"] = "Created"
+		t.Created("header")
+	})
+	f.Get("/not-found", func(t Template, data Data) {
+		data["Title"] = "Not Found"
+		t.NotFound("header")
+	})
+
+	tests := []struct {
+		url      string
+		wantCode int
+		wantBody string
+	}{
+		{url: "/ok", wantCode: http.StatusOK, wantBody: "<header>OK</header>"},
+		{url: "/created", wantCode: http.StatusCreated, wantBody: "<header>Created</header>"},
+		{url: "/not-found", wantCode: http.StatusNotFound, wantBody: "<header>Not Found</header>"},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			assert.Equal(t, test.wantBody, resp.Body.String())
+		})
+	}
+}
+
+func TestNewRenderError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantField string
+	}{
+		{
+			name:      "field",
+			err:       errors.New(`template: home:1:9: executing "home" at <.User.Name>: can't evaluate field Name in type string`),
+			wantField: ".User.Name",
+		},
+		{
+			name:      "missing key",
+			err:       errors.New(`template: home:1:2: executing "home" at <.Name>: map has no entry for key "Name"`),
+			wantField: ".Name",
+		},
+		{
+			name: "function",
+			err:  errors.New(`template: home:1:2: executing "home" at <fail>: error calling fail: failed`),
+		},
+		{
+			name: "no such template",
+			err:  errors.New(`html/template: "404" is undefined`),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := newRenderError("home", test.err)
+			assert.Equal(t, "home", got.Name)
+			assert.Equal(t, test.wantField, got.Field)
+			assert.Equal(t, test.err, errors.Unwrap(got))
+		})
+	}
+}
+
+func TestTemplate_OnError(t *testing.T) {
+	var gotErr error
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+			OnError: func(err error) {
+				gotErr = err
+			},
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Missing"] = "string"
+		t.HTML(http.StatusOK, "broken")
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+
+	var rerr *RenderError
+	require.True(t, errors.As(gotErr, &rerr))
+	assert.Equal(t, "broken", rerr.Name)
+	assert.Equal(t, ".Missing.Field", rerr.Field)
+}
+
+func TestTemplate_MissingTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		url      string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "existing",
+			opts:     Options{MissingTemplateStatus: http.StatusNotFound},
+			url:      "/home",
+			wantCode: http.StatusOK,
+			wantBody: "<p>Home</p>",
+		},
+		{
+			name:     "default",
+			url:      "/unknown",
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "status",
+			opts:     Options{MissingTemplateStatus: http.StatusNotFound},
+			url:      "/unknown",
+			wantCode: http.StatusNotFound,
+			wantBody: "Not Found\n",
+		},
+		{
+			name: "template",
+			opts: Options{
+				MissingTemplateStatus: http.StatusNotFound,
+				MissingTemplate:       "errors/404",
+			},
+			url:      "/unknown",
+			wantCode: http.StatusNotFound,
+			wantBody: "<h1>Page unknown not found</h1>",
+		},
+		{
+			name:     "template without status",
+			opts:     Options{MissingTemplate: "errors/404"},
+			url:      "/unknown",
+			wantCode: http.StatusInternalServerError,
+			wantBody: "<h1>Page unknown not found</h1>",
+		},
+		{
+			name: "missing error template",
+			opts: Options{
+				MissingTemplateStatus: http.StatusNotFound,
+				MissingTemplate:       "errors/missing",
+			},
+			url:      "/unknown",
+			wantCode: http.StatusNotFound,
+			wantBody: "Not Found\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.opts
+			opts.Directory = "testdata/missing"
+
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(opts))
+			f.Get("/{name}", func(c flamego.Context, tpl Template, data Data) {
+				data["Path"] = c.Param("name")
+				tpl.HTML(http.StatusOK, c.Param("name"))
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			if test.wantBody != "" {
+				assert.Equal(t, test.wantBody, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestTemplate_StatusFromTemplate(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory:      "testdata/status",
+			WithStatusFunc: true,
+		},
+	))
+	f.Get("/{name}", func(c flamego.Context, t Template) {
+		status := StatusFromTemplate
+		if c.Query("status") != "" {
+			status, _ = strconv.Atoi(c.Query("status"))
+		}
+		t.HTML(status, c.Param("name"))
+	})
+
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "set by template",
+			url:      "/notfound",
+			wantCode: http.StatusNotFound,
+			wantBody: "<h1>Not found</h1>",
+		},
+		{
+			name:     "not set by template",
+			url:      "/home",
+			wantCode: http.StatusOK,
+			wantBody: "<p>Home</p>",
+		},
+		{
+			name:     "set by handler",
+			url:      "/notfound?status=200",
+			wantCode: http.StatusOK,
+			wantBody: "<h1>Not found</h1>",
+		},
+		{
+			name:     "invalid status",
+			url:      "/invalid",
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+
+			assert.Equal(t, test.wantCode, resp.Code)
+			if test.wantBody != "" {
+				assert.Equal(t, test.wantBody, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestTemplate_MaxConcurrentRenders(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/concurrency",
+			FuncMaps: []gotemplate.FuncMap{
+				{
+					"wait": func() string {
+						started <- struct{}{}
+						<-release
+						return "done"
+					},
+				},
+			},
+			MaxConcurrentRenders: 1,
+			RenderQueueTimeout:   10 * time.Millisecond,
+			CacheMaxAge:          time.Hour,
+		},
+	))
+	f.Get("/", func(t Template) {
+		t.HTML(http.StatusOK, "home")
+	})
+
+	flamego.SetEnv(flamego.EnvTypeProd)
+	defer flamego.SetEnv(flamego.EnvTypeDev)
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		f.ServeHTTP(first, req)
+	}()
+	<-started
+
+	// The only render slot is taken by the first request.
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	f.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Empty(t, resp.Header().Get("Cache-Control"))
+
+	close(release)
+	<-done
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "<p>done</p>", first.Body.String())
+	assert.Equal(t, "max-age=3600", first.Header().Get("Cache-Control"))
+
+	// The render slot is released after the first request.
+	resp = httptest.NewRecorder()
+	f.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestEngine_MaxConcurrentRenders(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	e, err := NewEngine(
+		Options{
+			Directory: "testdata/concurrency",
+			FuncMaps: []gotemplate.FuncMap{
+				{
+					"wait": func() string {
+						started <- struct{}{}
+						<-release
+						return "done"
+					},
+				},
+			},
+			MaxConcurrentRenders: 1,
+			RenderQueueTimeout:   10 * time.Millisecond,
+		},
+	)
+	require.Nil(t, err)
+
+	// The limit is shared by all handlers of the engine.
+	newApp := func() *flamego.Flame {
+		f := flamego.NewWithLogger(&bytes.Buffer{})
+		f.Use(e.Handler())
+		f.Get("/", func(t Template) {
+			t.HTML(http.StatusOK, "home")
+		})
+		return f
+	}
+	first, second := newApp(), newApp()
+
+	flamego.SetEnv(flamego.EnvTypeProd)
+	defer flamego.SetEnv(flamego.EnvTypeDev)
+
+	firstResp := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		first.ServeHTTP(firstResp, req)
+	}()
+	<-started
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	second.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+
+	close(release)
+	<-done
+	assert.Equal(t, http.StatusOK, firstResp.Code)
+}
+
+func TestTemplate_HTMLLocalized(t *testing.T) {
+	tests := []struct {
+		name            string
+		defaultLanguage string
+		acceptLanguage  string
+		wantBody        string
+		wantLanguage    string
+	}{
+		{
+			name:           "exact match",
+			acceptLanguage: "zh-TW,en;q=0.8",
+			wantBody:       "<p>您好</p>",
+			wantLanguage:   "zh-TW",
+		},
+		{
+			name:           "primary subtag",
+			acceptLanguage: "zh-CN",
+			wantBody:       "<p>你好</p>",
+			wantLanguage:   "zh",
+		},
+		{
+			name:           "quality",
+			acceptLanguage: "fr,zh;q=0.5,en;q=0.8",
+			wantBody:       "<p>Hi</p>",
+			wantLanguage:   "en",
+		},
+		{
+			name:            "default language",
+			defaultLanguage: "zh",
+			acceptLanguage:  "fr",
+			wantBody:        "<p>你好</p>",
+			wantLanguage:    "zh",
+		},
+		{
+			name:           "no variant",
+			acceptLanguage: "fr,*;q=0.1,en;q=0",
+			wantBody:       "<p>Hello</p>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					Directory:       "testdata/localized",
+					DefaultLanguage: test.defaultLanguage,
+				},
+			))
+			f.Get("/", func(t Template) {
+				t.HTMLLocalized(http.StatusOK, "home")
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.Nil(t, err)
+			req.Header.Set("Accept-Language", test.acceptLanguage)
+
+			f.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, test.wantBody, resp.Body.String())
+			assert.Equal(t, test.wantLanguage, resp.Header().Get("Content-Language"))
+		})
+	}
+}
+
+func TestTemplate_HTMLImmutable(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		header     http.Header
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "render",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "<header>Flamego</header>",
+		},
+		{
+			name:       "if-none-match",
+			method:     http.MethodGet,
+			header:     http.Header{"If-None-Match": []string{`"v1"`}},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "if-modified-since",
+			method:     http.MethodHead,
+			header:     http.Header{"If-Modified-Since": []string{"Mon, 02 Jan 2006 15:04:05 GMT"}},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "unsafe method",
+			method:     http.MethodPost,
+			header:     http.Header{"If-None-Match": []string{`"v1"`}},
+			wantStatus: http.StatusOK,
+			wantBody:   "<header>Flamego</header>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := flamego.NewWithLogger(&bytes.Buffer{})
+			f.Use(Templater(
+				Options{
+					Directory:   "testdata/fragments",
+					CacheMaxAge: time.Minute,
+				},
+			))
+			f.Any("/", func(t Template, data Data) {
+				data["Title"] = "Flamego"
+				t.HTMLImmutable(http.StatusOK, "header")
+			})
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(test.method, "/", nil)
+			require.Nil(t, err)
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+
+			f.ServeHTTP(resp, req)
+			assert.Equal(t, test.wantStatus, resp.Code)
+			assert.Equal(t, test.wantBody, resp.Body.String())
+			assert.Equal(t, "public, max-age=31536000, immutable", resp.Header().Get("Cache-Control"))
+		})
+	}
+}
+
+func TestTemplate_Roots(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory: "testdata/fragments",
+			Roots: map[string]string{
+				"site":  "testdata/roots/site",
+				"admin": "testdata/roots/admin",
+			},
+		},
+	))
+	f.Get("/{name}", func(c flamego.Context, t Template, data Data) {
+		data["Title"] = "Flamego"
+		t.HTML(http.StatusOK, c.Param("name"))
+	})
+
+	tests := []struct {
+		name     string
+		template string
+		wantBody string
+	}{
+		{
+			name:     "default",
+			template: "header",
+			wantBody: "<header>Flamego</header>",
+		},
+		{
+			name:     "site",
+			template: "site:header",
+			wantBody: "<header>Site</header>",
+		},
+		{
+			name:     "admin",
+			template: "admin:page",
+			wantBody: "<header>Admin</header><main>Flamego</main>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/"+test.template, nil)
+			require.Nil(t, err)
+
+			f.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, test.wantBody, resp.Body.String())
+		})
+	}
+
+	t.Run("invalid namespace", func(t *testing.T) {
+		_, err := NewEngine(
+			Options{
+				Directory: "testdata/fragments",
+				Roots:     map[string]string{"a:b": "testdata/roots/site"},
+			},
+		)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), `invalid namespace "a:b"`)
+	})
+
+	t.Run("namespaced name with strict names", func(t *testing.T) {
+		_, err := NewEngine(
+			Options{
+				Directory: "testdata/fragments",
+				Roots:     map[string]string{"admin": "testdata/roots/admin"},
+				NameFunc: func(path, ext string) string {
+					return "admin:" + strings.TrimSuffix(path, ext)
+				},
+				StrictNames: true,
+			},
+		)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), `collides with namespace "admin"`)
+	})
+}
+
+func TestTemplate_HTMLScopes(t *testing.T) {
+	f := flamego.NewWithLogger(&bytes.Buffer{})
+	f.Use(Templater(
+		Options{
+			Directory:     "testdata/scopes",
+			WithScopeFunc: true,
+		},
+	))
+	f.Get("/", func(t Template, data Data) {
+		data["Title"] = "Home"
+		data["User"] = "Joe"
+		t.HTMLScopes(http.StatusOK, "page", map[string]Data{
+			"sidebar": {"Title": "Links"},
+		})
+	})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	f.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	// Keys of the scope take precedence, others and unknown scopes fall back to
+	// the data of the request.
+	assert.Equal(t, "<aside>Links: Joe</aside><main>Home</main><footer>Home</footer>", resp.Body.String())
+}